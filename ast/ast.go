@@ -1,9 +1,47 @@
 package ast
 
+import (
+	"gbnf/lexer"
+	"strings"
+)
+
+// AST is a parsed grammar, its Root holds the rules in the order of the input.
+// It's a Node itself so a whole grammar can be walked and rewritten
 type AST struct {
 	Root []Node
+	// Rules indexes the rules of Root by name, see Index
+	Rules *RuleTable
+	// Comments of the source in order, unless the lexer kept them as trivia
+	Comments []*lexer.Token
 }
 
 type Node interface {
 	String() string
+	// Pos returns the position of the first character of the node
+	Pos() lexer.Position
+	// End returns the position right after the last character of the node
+	End() lexer.Position
+}
+
+func (a *AST) String() string {
+	rules := make([]string, len(a.Root))
+	for i, rule := range a.Root {
+		rules[i] = rule.String()
+	}
+
+	return strings.Join(rules, "\n")
+}
+
+func (a *AST) Pos() lexer.Position {
+	if len(a.Root) == 0 {
+		return lexer.Position{}
+	}
+	return a.Root[0].Pos()
+}
+
+func (a *AST) End() lexer.Position {
+	if len(a.Root) == 0 {
+		return lexer.Position{}
+	}
+	return a.Root[len(a.Root)-1].End()
 }
@@ -0,0 +1,287 @@
+package ast
+
+import (
+	"fmt"
+	"gbnf/lexer"
+	"strconv"
+	"strings"
+)
+
+// Expr is implemented by every node that can appear on the right side of a production rule
+type Expr interface {
+	Node
+	exprNode()
+}
+
+// Alternation is a list of alternatives separated by "|".
+// Ors are the operators between the alternatives, they place the empty ones in the source
+type Alternation struct {
+	Alternatives []Expr
+	Ors          []*lexer.Token
+}
+
+func (a *Alternation) String() string {
+	alts := make([]string, len(a.Alternatives))
+	for i, alt := range a.Alternatives {
+		alts[i] = alt.String()
+	}
+
+	return strings.Join(alts, " | ")
+}
+
+// Sequence is a list of items that must match one after the other.
+// An empty sequence matches the empty string
+type Sequence struct {
+	Items []Expr
+}
+
+func (s *Sequence) String() string {
+	items := make([]string, len(s.Items))
+	for i, item := range s.Items {
+		items[i] = item.String()
+	}
+
+	return strings.Join(items, " ")
+}
+
+// Group is an expression enclosed in parentheses, or in braces when it's the Expr of a Repetition
+// written {x}, see Repetition
+type Group struct {
+	Lparen *lexer.Token
+	Expr   Expr
+	Rparen *lexer.Token
+}
+
+func (g *Group) String() string {
+	return fmt.Sprintf("(%s)", g.Expr)
+}
+
+// Optional is an expression enclosed in brackets, it matches zero or one time
+type Optional struct {
+	Lbrack *lexer.Token
+	Expr   Expr
+	Rbrack *lexer.Token
+}
+
+func (o *Optional) String() string {
+	return fmt.Sprintf("[%s]", o.Expr)
+}
+
+// Repetition matches Expr at least Min times and at most Max times.
+// A negative Max means there's no upper bound. The {x} of dialects with Dialect.BraceRepetition
+// is a Repetition of a Group enclosed in braces, Op is then the closing brace
+type Repetition struct {
+	Expr Expr
+	Min  int
+	Max  int
+	Op   *lexer.Token
+}
+
+func (r *Repetition) String() string {
+	if g := r.Braced(); g != nil {
+		return fmt.Sprintf("{%s}", g.Expr)
+	}
+
+	switch {
+	case r.Min == 0 && r.Max < 0:
+		return fmt.Sprintf("%s*", r.Expr)
+	case r.Min == 1 && r.Max < 0:
+		return fmt.Sprintf("%s+", r.Expr)
+	case r.Min == 0 && r.Max == 1:
+		return fmt.Sprintf("%s?", r.Expr)
+	case r.Max < 0:
+		return fmt.Sprintf("%s{%d,}", r.Expr, r.Min)
+	case r.Min == r.Max:
+		return fmt.Sprintf("%s{%d}", r.Expr, r.Min)
+	default:
+		return fmt.Sprintf("%s{%d,%d}", r.Expr, r.Min, r.Max)
+	}
+}
+
+// Braced returns the group of a repetition written {x}, nil if it's written with a postfix operator
+func (r *Repetition) Braced() *Group {
+	if g, ok := r.Expr.(*Group); ok && g.Lparen != nil && g.Lparen.Type == lexer.BraceLeft {
+		return g
+	}
+	return nil
+}
+
+// NotPredicate succeeds if Expr doesn't match, without consuming any input
+type NotPredicate struct {
+	Not  *lexer.Token
+	Expr Expr
+}
+
+func (n *NotPredicate) String() string {
+	return fmt.Sprintf("!%s", n.Expr)
+}
+
+// AndPredicate succeeds if Expr matches, without consuming any input
+type AndPredicate struct {
+	And  *lexer.Token
+	Expr Expr
+}
+
+func (a *AndPredicate) String() string {
+	return fmt.Sprintf("&%s", a.Expr)
+}
+
+// Range matches any character between From and To, e.g. "a" ... "z"
+type Range struct {
+	From *Literal
+	Op   *lexer.Token
+	To   *Literal
+}
+
+func (r *Range) String() string {
+	return fmt.Sprintf("%s ... %s", r.From, r.To)
+}
+
+// Literal is a terminal symbol
+type Literal struct {
+	Token *lexer.Token
+}
+
+func (l *Literal) String() string {
+	return strconv.Quote(l.Token.Lexeme)
+}
+
+// CharClass matches a single character of a set, e.g. [a-z0-9_] or [^"]
+type CharClass struct {
+	Token *lexer.Token
+}
+
+func (c *CharClass) String() string {
+	return c.Token.Set.String()
+}
+
+// NonTerminalRef is a reference to a production rule, e.g. <expr>
+type NonTerminalRef struct {
+	Name *lexer.Token
+}
+
+func (n *NonTerminalRef) String() string {
+	return fmt.Sprintf("<%s>", n.Name.Lexeme)
+}
+
+// Labeled binds the value matched by Expr to Label, so actions can refer to it, e.g. x=<expr>
+type Labeled struct {
+	Label  *lexer.Token
+	Assign *lexer.Token
+	Expr   Expr
+}
+
+func (l *Labeled) String() string {
+	return fmt.Sprintf("%s=%s", l.Label.Lexeme, l.Expr)
+}
+
+// ActionCall is a semantic action embedded in a rule, e.g. { Add(x, y) }
+type ActionCall struct {
+	Action *Action
+}
+
+func (a *ActionCall) String() string {
+	return fmt.Sprintf("{ %s }", a.Action)
+}
+
+// CodeBlock is raw host-language code embedded in a rule, e.g. {{ return Add(x, y), nil }}.
+// The code is kept verbatim in Token.Lexeme so generators can splice it in
+type CodeBlock struct {
+	Token *lexer.Token
+}
+
+func (c *CodeBlock) String() string {
+	return fmt.Sprintf("{{ %s }}", c.Token.Lexeme)
+}
+
+// BadExpr is a placeholder for the right side of a rule that couldn't be parsed,
+// it spans the skipped tokens
+type BadExpr struct {
+	From lexer.Position
+	To   lexer.Position
+}
+
+func (b *BadExpr) String() string {
+	return "<bad expression>"
+}
+
+// An empty sequence has no position, so the bounds of a list of expressions are
+// taken from the first and last expressions that have one
+func firstPos(exprs []Expr) lexer.Position {
+	for _, expr := range exprs {
+		if pos := expr.Pos(); pos.IsValid() {
+			return pos
+		}
+	}
+	return lexer.Position{}
+}
+
+func lastEnd(exprs []Expr) lexer.Position {
+	for i := len(exprs) - 1; i >= 0; i-- {
+		if end := exprs[i].End(); end.IsValid() {
+			return end
+		}
+	}
+	return lexer.Position{}
+}
+
+// The first and the last alternatives may be empty, the operators next to them bound the
+// alternation then
+func (a *Alternation) Pos() lexer.Position {
+	if len(a.Ors) == 0 || len(a.Alternatives) > 0 && a.Alternatives[0].Pos().IsValid() {
+		return firstPos(a.Alternatives)
+	}
+	return a.Ors[0].Start
+}
+
+func (a *Alternation) End() lexer.Position {
+	if n := len(a.Alternatives); len(a.Ors) == 0 || n > 0 && a.Alternatives[n-1].End().IsValid() {
+		return lastEnd(a.Alternatives)
+	}
+	return a.Ors[len(a.Ors)-1].End
+}
+
+func (s *Sequence) Pos() lexer.Position       { return firstPos(s.Items) }
+func (s *Sequence) End() lexer.Position       { return lastEnd(s.Items) }
+func (g *Group) Pos() lexer.Position          { return g.Lparen.Start }
+func (g *Group) End() lexer.Position          { return g.Rparen.End }
+func (o *Optional) Pos() lexer.Position       { return o.Lbrack.Start }
+func (o *Optional) End() lexer.Position       { return o.Rbrack.End }
+func (r *Repetition) Pos() lexer.Position     { return r.Expr.Pos() }
+func (r *Repetition) End() lexer.Position     { return r.Op.End }
+func (n *NotPredicate) Pos() lexer.Position   { return n.Not.Start }
+func (n *NotPredicate) End() lexer.Position   { return n.Expr.End() }
+func (a *AndPredicate) Pos() lexer.Position   { return a.And.Start }
+func (a *AndPredicate) End() lexer.Position   { return a.Expr.End() }
+func (r *Range) Pos() lexer.Position          { return r.From.Pos() }
+func (r *Range) End() lexer.Position          { return r.To.End() }
+func (l *Literal) Pos() lexer.Position        { return l.Token.Start }
+func (l *Literal) End() lexer.Position        { return l.Token.End }
+func (c *CharClass) Pos() lexer.Position      { return c.Token.Start }
+func (c *CharClass) End() lexer.Position      { return c.Token.End }
+func (n *NonTerminalRef) Pos() lexer.Position { return n.Name.Start }
+func (n *NonTerminalRef) End() lexer.Position { return n.Name.End }
+func (l *Labeled) Pos() lexer.Position        { return l.Label.Start }
+func (l *Labeled) End() lexer.Position        { return l.Expr.End() }
+func (a *ActionCall) Pos() lexer.Position     { return a.Action.Pos() }
+func (a *ActionCall) End() lexer.Position     { return a.Action.End() }
+func (c *CodeBlock) Pos() lexer.Position      { return c.Token.Start }
+func (c *CodeBlock) End() lexer.Position      { return c.Token.End }
+func (b *BadExpr) Pos() lexer.Position        { return b.From }
+func (b *BadExpr) End() lexer.Position        { return b.To }
+
+func (*Alternation) exprNode()    {}
+func (*Sequence) exprNode()       {}
+func (*Group) exprNode()          {}
+func (*Optional) exprNode()       {}
+func (*Repetition) exprNode()     {}
+func (*NotPredicate) exprNode()   {}
+func (*AndPredicate) exprNode()   {}
+func (*Range) exprNode()          {}
+func (*Literal) exprNode()        {}
+func (*CharClass) exprNode()      {}
+func (*NonTerminalRef) exprNode() {}
+func (*Labeled) exprNode()        {}
+func (*ActionCall) exprNode()     {}
+func (*CodeBlock) exprNode()      {}
+func (*BadExpr) exprNode()        {}
@@ -0,0 +1,554 @@
+package ast
+
+import (
+	"encoding/json"
+	"fmt"
+	"gbnf/lexer"
+)
+
+// JSONVersion is the version of the JSON encoding of trees, see AST.MarshalJSON. It changes
+// whenever the encoding changes in a way readers of the previous one can't cope with
+const JSONVersion = 1
+
+// MarshalJSON encodes the tree in version JSONVersion of its JSON encoding:
+//
+//	{"version": 1, "rules": [node, ...], "comments": [token, ...]}
+//
+// A node is an object with its "kind", the name of its type, and its fields named after the
+// fields of the type in camel case: tokens and lists of tokens, nodes and lists of nodes, "min"
+// and "max" of a Repetition, -1 standing for no bound, and "from" and "to" positions of a BadRule
+// or a BadExpr. Optional tokens like the "endOfRule" of a ProdRule are left out when there's none.
+//
+// A token is {"type", "lexeme", "raw", "start", "end"}, the type by name, plus the trivia as
+// "leadingTrivia" and "trailingTrivia" when there's some and the "set" of a CharClass with its
+// "negated" flag, "ranges" of runes {"lo", "hi"} and Unicode "classes" {"name", "negated"}.
+// A position is {"offset", "line", "column"}, plus "pos" when the source is in a FileSet.
+//
+// The rule table isn't encoded, it's built again by UnmarshalJSON
+func (a *AST) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonTree{
+		Version:  JSONVersion,
+		Rules:    wrapNodes(a.Root),
+		Comments: encodeTokens(a.Comments),
+	})
+}
+
+// UnmarshalJSON rebuilds a tree encoded by MarshalJSON and indexes its rules like the parser does,
+// the errors of the index are left to the one who encoded the tree
+func (a *AST) UnmarshalJSON(data []byte) error {
+	var version struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &version); err != nil {
+		return err
+	}
+	if version.Version != JSONVersion {
+		return fmt.Errorf("%w %d, expected %d", ErrJSONVersion, version.Version, JSONVersion)
+	}
+
+	var tree jsonTree
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return err
+	}
+
+	d := &decoder{kind: "tree"}
+	root := make([]Node, len(tree.Rules))
+	for i, rule := range tree.Rules {
+		switch rule.Node.(type) {
+		case *ProdRule, *BadRule:
+			root[i] = rule.Node
+		default:
+			d.fail("rule", rule.Node)
+		}
+	}
+	var comments []*lexer.Token
+	for _, comment := range tree.Comments {
+		comments = append(comments, d.token("comment", comment, true, lexer.Comment))
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	*a = AST{Root: root, Comments: comments}
+	a.Index()
+
+	return nil
+}
+
+type jsonTree struct {
+	Version  int          `json:"version"`
+	Rules    []jsonNode   `json:"rules"`
+	Comments []*jsonToken `json:"comments,omitempty"`
+}
+
+// jsonNode is a node of any type, encoded along with its kind
+type jsonNode struct {
+	Node
+}
+
+func (n jsonNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(encodeNode(n.Node))
+}
+
+func (n *jsonNode) UnmarshalJSON(data []byte) (err error) {
+	if string(data) == "null" {
+		n.Node = nil
+		return nil
+	}
+
+	n.Node, err = decodeNode(data)
+	return err
+}
+
+type jsonToken struct {
+	Type           string       `json:"type"`
+	Lexeme         string       `json:"lexeme"`
+	Raw            string       `json:"raw"`
+	Start          jsonPosition `json:"start"`
+	End            jsonPosition `json:"end"`
+	LeadingTrivia  string       `json:"leadingTrivia,omitempty"`
+	TrailingTrivia string       `json:"trailingTrivia,omitempty"`
+	Set            *jsonCharSet `json:"set,omitempty"`
+}
+
+type jsonPosition struct {
+	Offset int  `json:"offset"`
+	Line   uint `json:"line"`
+	Column uint `json:"column"`
+	Pos    int  `json:"pos,omitempty"`
+}
+
+type jsonCharSet struct {
+	Negated bool               `json:"negated"`
+	Ranges  []jsonCharRange    `json:"ranges"`
+	Classes []jsonUnicodeClass `json:"classes"`
+}
+
+type jsonCharRange struct {
+	Lo rune `json:"lo"`
+	Hi rune `json:"hi"`
+}
+
+type jsonUnicodeClass struct {
+	Name    string `json:"name"`
+	Negated bool   `json:"negated"`
+}
+
+// The encodings of the nodes, the kind comes first
+type (
+	jsonProdRule struct {
+		Kind      string     `json:"kind"`
+		Left      *jsonToken `json:"left"`
+		Define    *jsonToken `json:"define"`
+		Right     jsonNode   `json:"right"`
+		EndOfRule *jsonToken `json:"endOfRule,omitempty"`
+	}
+	jsonBad struct {
+		Kind string       `json:"kind"`
+		From jsonPosition `json:"from"`
+		To   jsonPosition `json:"to"`
+	}
+	jsonAlternation struct {
+		Kind         string       `json:"kind"`
+		Alternatives []jsonNode   `json:"alternatives"`
+		Ors          []*jsonToken `json:"ors,omitempty"`
+	}
+	jsonSequence struct {
+		Kind  string     `json:"kind"`
+		Items []jsonNode `json:"items"`
+	}
+	jsonGroup struct {
+		Kind   string     `json:"kind"`
+		Lparen *jsonToken `json:"lparen"`
+		Expr   jsonNode   `json:"expr"`
+		Rparen *jsonToken `json:"rparen"`
+	}
+	jsonOptional struct {
+		Kind   string     `json:"kind"`
+		Lbrack *jsonToken `json:"lbrack"`
+		Expr   jsonNode   `json:"expr"`
+		Rbrack *jsonToken `json:"rbrack"`
+	}
+	jsonRepetition struct {
+		Kind string     `json:"kind"`
+		Expr jsonNode   `json:"expr"`
+		Min  int        `json:"min"`
+		Max  int        `json:"max"`
+		Op   *jsonToken `json:"op"`
+	}
+	jsonNotPredicate struct {
+		Kind string     `json:"kind"`
+		Not  *jsonToken `json:"not"`
+		Expr jsonNode   `json:"expr"`
+	}
+	jsonAndPredicate struct {
+		Kind string     `json:"kind"`
+		And  *jsonToken `json:"and"`
+		Expr jsonNode   `json:"expr"`
+	}
+	jsonRange struct {
+		Kind string     `json:"kind"`
+		From jsonNode   `json:"from"`
+		Op   *jsonToken `json:"op"`
+		To   jsonNode   `json:"to"`
+	}
+	// Literal, CharClass, CodeBlock and ActionLiteral
+	jsonLeaf struct {
+		Kind  string     `json:"kind"`
+		Token *jsonToken `json:"token"`
+	}
+	// NonTerminalRef and ActionRef
+	jsonRef struct {
+		Kind string     `json:"kind"`
+		Name *jsonToken `json:"name"`
+	}
+	jsonLabeled struct {
+		Kind   string     `json:"kind"`
+		Label  *jsonToken `json:"label"`
+		Assign *jsonToken `json:"assign"`
+		Expr   jsonNode   `json:"expr"`
+	}
+	jsonActionCall struct {
+		Kind   string   `json:"kind"`
+		Action jsonNode `json:"action"`
+	}
+	jsonAction struct {
+		Kind   string     `json:"kind"`
+		Action *jsonToken `json:"action"`
+		Args   []jsonNode `json:"args"`
+		Rparen *jsonToken `json:"rparen"`
+	}
+	jsonActionList struct {
+		Kind   string     `json:"kind"`
+		Lbrack *jsonToken `json:"lbrack"`
+		Elems  []jsonNode `json:"elems"`
+		Rbrack *jsonToken `json:"rbrack"`
+	}
+)
+
+func encodeNode(node Node) any {
+	switch n := node.(type) {
+	case nil:
+		return nil
+	case *ProdRule:
+		return jsonProdRule{"ProdRule", encodeToken(n.Left), encodeToken(n.Define), jsonNode{n.Right}, encodeToken(n.EndOfRule)}
+	case *BadRule:
+		return jsonBad{"BadRule", encodePosition(n.From), encodePosition(n.To)}
+	case *BadExpr:
+		return jsonBad{"BadExpr", encodePosition(n.From), encodePosition(n.To)}
+	case *Alternation:
+		return jsonAlternation{"Alternation", wrapNodes(n.Alternatives), encodeTokens(n.Ors)}
+	case *Sequence:
+		return jsonSequence{"Sequence", wrapNodes(n.Items)}
+	case *Group:
+		return jsonGroup{"Group", encodeToken(n.Lparen), jsonNode{n.Expr}, encodeToken(n.Rparen)}
+	case *Optional:
+		return jsonOptional{"Optional", encodeToken(n.Lbrack), jsonNode{n.Expr}, encodeToken(n.Rbrack)}
+	case *Repetition:
+		return jsonRepetition{"Repetition", jsonNode{n.Expr}, n.Min, n.Max, encodeToken(n.Op)}
+	case *NotPredicate:
+		return jsonNotPredicate{"NotPredicate", encodeToken(n.Not), jsonNode{n.Expr}}
+	case *AndPredicate:
+		return jsonAndPredicate{"AndPredicate", encodeToken(n.And), jsonNode{n.Expr}}
+	case *Range:
+		return jsonRange{"Range", jsonNode{n.From}, encodeToken(n.Op), jsonNode{n.To}}
+	case *Literal:
+		return jsonLeaf{"Literal", encodeToken(n.Token)}
+	case *CharClass:
+		return jsonLeaf{"CharClass", encodeToken(n.Token)}
+	case *CodeBlock:
+		return jsonLeaf{"CodeBlock", encodeToken(n.Token)}
+	case *ActionLiteral:
+		return jsonLeaf{"ActionLiteral", encodeToken(n.Token)}
+	case *NonTerminalRef:
+		return jsonRef{"NonTerminalRef", encodeToken(n.Name)}
+	case *ActionRef:
+		return jsonRef{"ActionRef", encodeToken(n.Name)}
+	case *Labeled:
+		return jsonLabeled{"Labeled", encodeToken(n.Label), encodeToken(n.Assign), jsonNode{n.Expr}}
+	case *ActionCall:
+		return jsonActionCall{"ActionCall", jsonNode{n.Action}}
+	case *Action:
+		return jsonAction{"Action", encodeToken(n.Action), wrapNodes(n.Args), encodeToken(n.Rparen)}
+	case *ActionList:
+		return jsonActionList{"ActionList", encodeToken(n.Lbrack), wrapNodes(n.Elems), encodeToken(n.Rbrack)}
+	default:
+		panic(fmt.Sprintf("ast: unexpected node type %T", n))
+	}
+}
+
+func wrapNodes[T Node](nodes []T) []jsonNode {
+	wrapped := make([]jsonNode, len(nodes))
+	for i, n := range nodes {
+		wrapped[i] = jsonNode{n}
+	}
+
+	return wrapped
+}
+
+func encodeTokens(tokens []*lexer.Token) []*jsonToken {
+	encoded := make([]*jsonToken, len(tokens))
+	for i, t := range tokens {
+		encoded[i] = encodeToken(t)
+	}
+
+	return encoded
+}
+
+func encodeToken(t *lexer.Token) *jsonToken {
+	if t == nil {
+		return nil
+	}
+
+	token := &jsonToken{
+		Type:           t.Type.String(),
+		Lexeme:         t.Lexeme,
+		Raw:            t.Raw,
+		Start:          encodePosition(t.Start),
+		End:            encodePosition(t.End),
+		LeadingTrivia:  t.LeadingTrivia,
+		TrailingTrivia: t.TrailingTrivia,
+	}
+	if t.Set != nil {
+		token.Set = &jsonCharSet{
+			Negated: t.Set.Negated,
+			Ranges:  make([]jsonCharRange, len(t.Set.Ranges)),
+			Classes: make([]jsonUnicodeClass, len(t.Set.Classes)),
+		}
+		for i, r := range t.Set.Ranges {
+			token.Set.Ranges[i] = jsonCharRange{r.Lo, r.Hi}
+		}
+		for i, c := range t.Set.Classes {
+			token.Set.Classes[i] = jsonUnicodeClass{c.Name, c.Negated}
+		}
+	}
+
+	return token
+}
+
+func encodePosition(p lexer.Position) jsonPosition {
+	return jsonPosition{Offset: p.Offset, Line: p.Line, Column: p.Column, Pos: int(p.Pos)}
+}
+
+// tokenTypes maps the names of the token types back to them
+var tokenTypes = func() map[string]lexer.TokenType {
+	types := make(map[string]lexer.TokenType)
+	for t := lexer.TokenType(0); t.String() != "Unknown"; t++ {
+		types[t.String()] = t
+	}
+	return types
+}()
+
+// repetitionOps are the token types of Repetition.Op, the closing brace for {x}
+var repetitionOps = []lexer.TokenType{lexer.ZeroOrMore, lexer.OneOrMore, lexer.ZeroOrOne, lexer.Repeat, lexer.BraceRight}
+
+func decodeNode(data []byte) (Node, error) {
+	var head struct {
+		Kind string `json:"kind"`
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, err
+	}
+
+	d := &decoder{kind: head.Kind}
+	var node Node
+	switch head.Kind {
+	case "ProdRule":
+		var v jsonProdRule
+		d.unmarshal(data, &v)
+		node = &ProdRule{
+			Left:      d.token("left", v.Left, true, lexer.NonTerminalSymbol),
+			Define:    d.token("define", v.Define, true, lexer.ProdRule, lexer.Extend),
+			Right:     field[Expr](d, "right", v.Right),
+			EndOfRule: d.token("endOfRule", v.EndOfRule, false, lexer.EndOfRule),
+		}
+	case "BadRule", "BadExpr":
+		var v jsonBad
+		d.unmarshal(data, &v)
+		if head.Kind == "BadRule" {
+			node = &BadRule{From: decodePosition(v.From), To: decodePosition(v.To)}
+		} else {
+			node = &BadExpr{From: decodePosition(v.From), To: decodePosition(v.To)}
+		}
+	case "Alternation":
+		var v jsonAlternation
+		d.unmarshal(data, &v)
+		alt := &Alternation{Alternatives: fields[Expr](d, "alternatives", v.Alternatives)}
+		for _, or := range v.Ors {
+			alt.Ors = append(alt.Ors, d.token("ors", or, true, lexer.Or))
+		}
+		node = alt
+	case "Sequence":
+		var v jsonSequence
+		d.unmarshal(data, &v)
+		node = &Sequence{Items: fields[Expr](d, "items", v.Items)}
+	case "Group":
+		var v jsonGroup
+		d.unmarshal(data, &v)
+		// The group of a braced repetition keeps the braces
+		rparen := lexer.ParenRight
+		lparen := d.token("lparen", v.Lparen, true, lexer.ParenLeft, lexer.BraceLeft)
+		if lparen != nil && lparen.Type == lexer.BraceLeft {
+			rparen = lexer.BraceRight
+		}
+		node = &Group{Lparen: lparen, Expr: field[Expr](d, "expr", v.Expr), Rparen: d.token("rparen", v.Rparen, true, rparen)}
+	case "Optional":
+		var v jsonOptional
+		d.unmarshal(data, &v)
+		node = &Optional{Lbrack: d.token("lbrack", v.Lbrack, true, lexer.BracketLeft), Expr: field[Expr](d, "expr", v.Expr), Rbrack: d.token("rbrack", v.Rbrack, true, lexer.BracketRight)}
+	case "Repetition":
+		var v jsonRepetition
+		d.unmarshal(data, &v)
+		node = &Repetition{Expr: field[Expr](d, "expr", v.Expr), Min: v.Min, Max: v.Max, Op: d.token("op", v.Op, true, repetitionOps...)}
+	case "NotPredicate":
+		var v jsonNotPredicate
+		d.unmarshal(data, &v)
+		node = &NotPredicate{Not: d.token("not", v.Not, true, lexer.Not), Expr: field[Expr](d, "expr", v.Expr)}
+	case "AndPredicate":
+		var v jsonAndPredicate
+		d.unmarshal(data, &v)
+		node = &AndPredicate{And: d.token("and", v.And, true, lexer.And), Expr: field[Expr](d, "expr", v.Expr)}
+	case "Range":
+		var v jsonRange
+		d.unmarshal(data, &v)
+		node = &Range{From: field[*Literal](d, "from", v.From), Op: d.token("op", v.Op, true, lexer.Sequence), To: field[*Literal](d, "to", v.To)}
+	case "Literal", "CharClass", "CodeBlock", "ActionLiteral":
+		var v jsonLeaf
+		d.unmarshal(data, &v)
+		switch head.Kind {
+		case "Literal":
+			node = &Literal{Token: d.token("token", v.Token, true, lexer.TerminalSymbol)}
+		case "CharClass":
+			token := d.token("token", v.Token, true, lexer.CharClass)
+			if token != nil && token.Set == nil {
+				d.fail("token set", nil)
+			}
+			node = &CharClass{Token: token}
+		case "CodeBlock":
+			node = &CodeBlock{Token: d.token("token", v.Token, true, lexer.CodeBlock)}
+		default:
+			node = &ActionLiteral{Token: d.token("token", v.Token, true, lexer.ActionString, lexer.ActionNumber)}
+		}
+	case "NonTerminalRef", "ActionRef":
+		var v jsonRef
+		d.unmarshal(data, &v)
+		if head.Kind == "NonTerminalRef" {
+			node = &NonTerminalRef{Name: d.token("name", v.Name, true, lexer.NonTerminalSymbol)}
+		} else {
+			node = &ActionRef{Name: d.token("name", v.Name, true, lexer.ActionArg)}
+		}
+	case "Labeled":
+		var v jsonLabeled
+		d.unmarshal(data, &v)
+		node = &Labeled{Label: d.token("label", v.Label, true, lexer.TerminalSymbol, lexer.NonTerminalSymbol), Assign: d.token("assign", v.Assign, true, lexer.Assign), Expr: field[Expr](d, "expr", v.Expr)}
+	case "ActionCall":
+		var v jsonActionCall
+		d.unmarshal(data, &v)
+		node = &ActionCall{Action: field[*Action](d, "action", v.Action)}
+	case "Action":
+		var v jsonAction
+		d.unmarshal(data, &v)
+		node = &Action{Action: d.token("action", v.Action, true, lexer.Action), Args: fields[ActionArg](d, "args", v.Args), Rparen: d.token("rparen", v.Rparen, true, lexer.ActionCallEnd)}
+	case "ActionList":
+		var v jsonActionList
+		d.unmarshal(data, &v)
+		node = &ActionList{Lbrack: d.token("lbrack", v.Lbrack, true, lexer.ActionList), Elems: fields[ActionArg](d, "elems", v.Elems), Rbrack: d.token("rbrack", v.Rbrack, true, lexer.ActionListEnd)}
+	default:
+		return nil, fmt.Errorf("%w: unknown kind %q", ErrInvalidJSON, head.Kind)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return node, nil
+}
+
+// decoder decodes the fields of a node of a kind, the first error is kept and the fields after it
+// are decoded to zero values
+type decoder struct {
+	kind string
+	err  error
+}
+
+func (d *decoder) fail(field string, v any) {
+	switch {
+	case d.err != nil:
+	case v == nil:
+		d.err = fmt.Errorf("%w: %s without %s", ErrInvalidJSON, d.kind, field)
+	default:
+		if _, ok := v.(Node); ok {
+			v = fmt.Sprintf("%T", v)
+		}
+		d.err = fmt.Errorf("%w: unexpected %s of %s: %v", ErrInvalidJSON, field, d.kind, v)
+	}
+}
+
+func (d *decoder) unmarshal(data []byte, v any) {
+	if err := json.Unmarshal(data, v); err != nil && d.err == nil {
+		d.err = err
+	}
+}
+
+// token decodes a token field, which must have one of types
+func (d *decoder) token(field string, t *jsonToken, required bool, types ...lexer.TokenType) *lexer.Token {
+	if t == nil {
+		if required {
+			d.fail(field, nil)
+		}
+		return nil
+	}
+
+	typ, known := tokenTypes[t.Type]
+	ok := false
+	for _, expected := range types {
+		ok = ok || typ == expected
+	}
+	if !known || !ok {
+		d.fail(field, t.Type)
+		return nil
+	}
+
+	token := &lexer.Token{
+		Lexeme:         t.Lexeme,
+		Raw:            t.Raw,
+		Type:           typ,
+		Start:          decodePosition(t.Start),
+		End:            decodePosition(t.End),
+		LeadingTrivia:  t.LeadingTrivia,
+		TrailingTrivia: t.TrailingTrivia,
+	}
+	if t.Set != nil {
+		token.Set = &lexer.CharSet{Negated: t.Set.Negated}
+		for _, r := range t.Set.Ranges {
+			token.Set.Ranges = append(token.Set.Ranges, lexer.CharRange{Lo: r.Lo, Hi: r.Hi})
+		}
+		for _, c := range t.Set.Classes {
+			token.Set.Classes = append(token.Set.Classes, lexer.UnicodeClass{Name: c.Name, Negated: c.Negated})
+		}
+	}
+
+	return token
+}
+
+func decodePosition(p jsonPosition) lexer.Position {
+	return lexer.Position{Offset: p.Offset, Line: p.Line, Column: p.Column, Pos: lexer.Pos(p.Pos)}
+}
+
+// field returns the node of a field, which must be a T
+func field[T Node](d *decoder, name string, n jsonNode) T {
+	t, ok := n.Node.(T)
+	if !ok {
+		d.fail(name, n.Node)
+	}
+	return t
+}
+
+func fields[T Node](d *decoder, name string, nodes []jsonNode) []T {
+	decoded := make([]T, len(nodes))
+	for i, n := range nodes {
+		decoded[i] = field[T](d, name, n)
+	}
+
+	return decoded
+}
@@ -0,0 +1,82 @@
+package ast_test
+
+import (
+	"encoding/json"
+	"errors"
+	"gbnf/ast"
+	"gbnf/lexer"
+	"gbnf/parser"
+	"reflect"
+	"testing"
+)
+
+// Testing if a tree encoded as JSON is rebuilt as it was, tokens and positions included
+func TestAST_JSON(t *testing.T) {
+	src := "# list\n<list> ::= x=<item> (\",\" <item>)* { List(x, \"a\", [1, y]) } !!\n" +
+		"<item> ::= [a-z\\p{L}]+ | !\"0\" ... \"9\"{2,} | &[<item>] {{ return nil }}\n<item> |= \"q\"?"
+
+	tree, err := parser.ParseString(src, lexer.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded ast.AST
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tree, &decoded) {
+		t.Fatalf("Expected %s, got %s", tree, &decoded)
+	}
+	if decoded.Rule("item") == nil || len(decoded.Rule("item").Extensions) != 1 {
+		t.Fatal("Expected the rules of the decoded tree to be indexed")
+	}
+
+	var head struct {
+		Version int
+		Rules   []struct {
+			Kind string
+			Left struct {
+				Type  string
+				Start struct{ Line, Column int }
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &head); err != nil {
+		t.Fatal(err)
+	}
+	if head.Version != ast.JSONVersion || head.Rules[1].Kind != "ProdRule" || head.Rules[1].Left.Type != "NonTerminalSymbol" ||
+		head.Rules[1].Left.Start.Line != 3 {
+		t.Fatalf("Expected the second rule at line 3, got %s", data)
+	}
+}
+
+// Testing if JSON of another version or with broken nodes is refused
+func TestAST_JSONErrors(t *testing.T) {
+	var tree ast.AST
+
+	err := json.Unmarshal([]byte(`{"version": 2, "rules": []}`), &tree)
+	if !errors.Is(err, ast.ErrJSONVersion) {
+		t.Fatalf("Expected %v, got %v", ast.ErrJSONVersion, err)
+	}
+
+	tests := []string{
+		`{"version": 1, "rules": [{"kind": "Widget"}]}`,
+		`{"version": 1, "rules": [{"kind": "Literal", "token": {"type": "TerminalSymbol"}}]}`,
+		`{"version": 1, "rules": [{"kind": "ProdRule", "define": {"type": "ProdRule"}, "right": {"kind": "Sequence", "items": []}}]}`,
+		`{"version": 1, "rules": [{"kind": "Group", "lparen": {"type": "Nope"}}]}`,
+		`{"version": 1, "rules": [{"kind": "ProdRule", "left": {"type": "NonTerminalSymbol"}, "define": {"type": "ProdRule"}, "right": {"kind": "CharClass", "token": {"type": "CharClass", "raw": "[a]"}}}]}`,
+		`{"version": 1, "rules": [{"kind": "ProdRule", "left": {"type": "NonTerminalSymbol"}, "define": {"type": "ProdRule"}, "right": {"kind": "Literal", "token": {"type": "CodeBlock"}}}]}`,
+		`{"version": 1, "rules": [{"kind": "ProdRule", "left": {"type": "TerminalSymbol"}, "define": {"type": "ProdRule"}, "right": {"kind": "Literal", "token": {"type": "TerminalSymbol"}}}]}`,
+		`{"version": 1, "rules": [{"kind": "ProdRule", "left": {"type": "NonTerminalSymbol"}, "define": {"type": "ProdRule"}, "right": {"kind": "Literal", "token": {"type": "Nope"}}}]}`,
+	}
+	for _, test := range tests {
+		if err := json.Unmarshal([]byte(test), &tree); !errors.Is(err, ast.ErrInvalidJSON) {
+			t.Fatalf("Expected %v for %s, got %v", ast.ErrInvalidJSON, test, err)
+		}
+	}
+}
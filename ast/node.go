@@ -3,22 +3,155 @@ package ast
 import (
 	"fmt"
 	"gbnf/lexer"
+	"strconv"
+	"strings"
 )
 
 type ProdRule struct {
-	Left  *lexer.Token
-	Right []*lexer.Token
+	Left *lexer.Token
+	// The "::=" token, or the "|=" token of a rule extending another one
+	Define *lexer.Token
+	Right  Expr
+	// The optional "!!" token, nil if the rule isn't terminated explicitly
+	EndOfRule *lexer.Token
 }
 
 func (p *ProdRule) String() string {
-	return fmt.Sprintf("%s ::= %s", p.Left, p.Right)
+	if p.IsExtension() {
+		return fmt.Sprintf("<%s> |= %s", p.Left.Lexeme, p.Right)
+	}
+	return fmt.Sprintf("<%s> ::= %s", p.Left.Lexeme, p.Right)
 }
 
+// IsExtension reports whether the rule adds alternatives to a rule defined before, <expr> |= ...
+func (p *ProdRule) IsExtension() bool {
+	return p.Define.Type == lexer.Extend
+}
+
+func (p *ProdRule) Pos() lexer.Position {
+	return p.Left.Start
+}
+
+func (p *ProdRule) End() lexer.Position {
+	if p.EndOfRule != nil {
+		return p.EndOfRule.End
+	}
+	if end := p.Right.End(); end.IsValid() {
+		return end
+	}
+	return p.Define.End
+}
+
+// BadRule is a placeholder for text that couldn't be parsed as a rule, it spans the skipped tokens
+type BadRule struct {
+	From lexer.Position
+	To   lexer.Position
+}
+
+func (b *BadRule) String() string {
+	return "<bad rule>"
+}
+
+func (b *BadRule) Pos() lexer.Position {
+	return b.From
+}
+
+func (b *BadRule) End() lexer.Position {
+	return b.To
+}
+
+// ActionArg is an argument of a semantic action: a nested call, a label reference, a literal or a list
+type ActionArg interface {
+	Node
+	actionArg()
+}
+
+// Action is a call in a semantic action, e.g. Add(x, Mul(y, 2)). Nested calls are Actions too
 type Action struct {
 	Action *lexer.Token
-	Args   []*lexer.Token
+	Args   []ActionArg
+	// The ")" ending the call
+	Rparen *lexer.Token
 }
 
 func (a *Action) String() string {
-	return fmt.Sprintf("%s(%s)", a.Action, a.Args)
+	return fmt.Sprintf("%s(%s)", a.Action.Lexeme, joinArgs(a.Args))
+}
+
+func (a *Action) Pos() lexer.Position {
+	return a.Action.Start
+}
+
+func (a *Action) End() lexer.Position {
+	return a.Rparen.End
+}
+
+// ActionRef is a reference to a labeled element of the rule, the x in x=<expr>
+type ActionRef struct {
+	Name *lexer.Token
+}
+
+func (a *ActionRef) String() string {
+	return a.Name.Lexeme
 }
+
+func (a *ActionRef) Pos() lexer.Position {
+	return a.Name.Start
+}
+
+func (a *ActionRef) End() lexer.Position {
+	return a.Name.End
+}
+
+// ActionLiteral is a string or a number passed to an action, the Type of the token tells which
+type ActionLiteral struct {
+	Token *lexer.Token
+}
+
+func (a *ActionLiteral) String() string {
+	if a.Token.Type == lexer.ActionString {
+		return strconv.Quote(a.Token.Lexeme)
+	}
+	return a.Token.Lexeme
+}
+
+func (a *ActionLiteral) Pos() lexer.Position {
+	return a.Token.Start
+}
+
+func (a *ActionLiteral) End() lexer.Position {
+	return a.Token.End
+}
+
+// ActionList is a list passed to an action, e.g. [x, y]
+type ActionList struct {
+	Lbrack *lexer.Token
+	Elems  []ActionArg
+	Rbrack *lexer.Token
+}
+
+func (a *ActionList) String() string {
+	return fmt.Sprintf("[%s]", joinArgs(a.Elems))
+}
+
+func (a *ActionList) Pos() lexer.Position {
+	return a.Lbrack.Start
+}
+
+func (a *ActionList) End() lexer.Position {
+	return a.Rbrack.End
+}
+
+func joinArgs(args []ActionArg) string {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = arg.String()
+	}
+
+	return strings.Join(strs, ", ")
+}
+
+func (*Action) actionArg()        {}
+func (*ActionRef) actionArg()     {}
+func (*ActionLiteral) actionArg() {}
+func (*ActionList) actionArg()    {}
@@ -0,0 +1,230 @@
+package ast
+
+import "fmt"
+
+// ApplyFunc is called by Rewrite for each node, see Rewrite
+type ApplyFunc func(*Cursor) bool
+
+// Rewrite traverses a tree in depth-first order like Walk and lets pre and post change it through
+// the Cursor they get: pre is called before the children of a node are traversed, post after.
+// If pre returns false the children are skipped and post isn't called, if post returns false
+// the traversal stops. Either function may be nil.
+// Nodes inserted or replacing the current one aren't traversed, except that the children of a
+// node replaced in pre are. Rewrite returns the root, which may have been replaced
+func Rewrite(root Node, pre, post ApplyFunc) (result Node) {
+	result = root
+	r := &rewriter{pre: pre, post: post}
+
+	defer func() {
+		if p := recover(); p != nil && p != abort {
+			panic(p)
+		}
+	}()
+	r.applyField(nil, "", root, func(n Node) { result = n })
+
+	return result
+}
+
+// abort is the panic unwinding Rewrite when post returns false
+var abort = new(int)
+
+// Cursor describes the node being visited by Rewrite and where it is in its parent
+type Cursor struct {
+	parent Node
+	name   string
+	iter   *iterator
+	list   list
+	node   Node
+	// Sets the field of parent holding node, nil if node is in a list
+	set func(Node)
+}
+
+type iterator struct {
+	index, step int
+}
+
+// Node returns the current node
+func (c *Cursor) Node() Node {
+	return c.node
+}
+
+// Parent returns the parent of the current node, nil for the root
+func (c *Cursor) Parent() Node {
+	return c.parent
+}
+
+// Name returns the name of the field of the parent holding the current node, e.g. "Items"
+func (c *Cursor) Name() string {
+	return c.name
+}
+
+// Index returns the index of the current node in its list, or -1 if it isn't in a list
+func (c *Cursor) Index() int {
+	if c.list == nil {
+		return -1
+	}
+	return c.iter.index
+}
+
+// Replace replaces the current node with n. It panics if n can't be held by the field of the parent
+func (c *Cursor) Replace(n Node) {
+	if c.list != nil {
+		c.list.set(c.iter.index, n)
+	} else {
+		c.set(n)
+	}
+	c.node = n
+}
+
+// Delete deletes the current node from its list. It panics if the node isn't in a list
+func (c *Cursor) Delete() {
+	if c.list == nil {
+		panic("ast: Delete of a node that isn't in a list")
+	}
+	c.list.delete(c.iter.index)
+	c.iter.step--
+	c.node = nil
+}
+
+// InsertAfter inserts n after the current node in its list, n isn't traversed.
+// It panics if the node isn't in a list
+func (c *Cursor) InsertAfter(n Node) {
+	if c.list == nil {
+		panic("ast: InsertAfter of a node that isn't in a list")
+	}
+	c.list.insert(c.iter.index+1, n)
+	c.iter.step++
+}
+
+// InsertBefore inserts n before the current node in its list, n isn't traversed.
+// It panics if the node isn't in a list
+func (c *Cursor) InsertBefore(n Node) {
+	if c.list == nil {
+		panic("ast: InsertBefore of a node that isn't in a list")
+	}
+	c.list.insert(c.iter.index, n)
+	c.iter.index++
+}
+
+// list is a slice field of a node, whatever the type of its elements
+type list interface {
+	len() int
+	at(i int) Node
+	set(i int, n Node)
+	insert(i int, n Node)
+	delete(i int)
+}
+
+type nodeList[T Node] struct {
+	s *[]T
+}
+
+func (l *nodeList[T]) len() int {
+	return len(*l.s)
+}
+
+func (l *nodeList[T]) at(i int) Node {
+	return (*l.s)[i]
+}
+
+func (l *nodeList[T]) set(i int, n Node) {
+	(*l.s)[i] = as[T](n)
+}
+
+func (l *nodeList[T]) insert(i int, n Node) {
+	var zero T
+	*l.s = append(*l.s, zero)
+	copy((*l.s)[i+1:], (*l.s)[i:])
+	(*l.s)[i] = as[T](n)
+}
+
+func (l *nodeList[T]) delete(i int) {
+	n := copy((*l.s)[i:], (*l.s)[i+1:])
+	var zero T
+	(*l.s)[i+n] = zero
+	*l.s = (*l.s)[:i+n]
+}
+
+func as[T Node](n Node) T {
+	t, ok := n.(T)
+	if !ok {
+		panic(fmt.Sprintf("ast: a %T can't be put there", n))
+	}
+	return t
+}
+
+type rewriter struct {
+	pre, post ApplyFunc
+	cursor    Cursor
+}
+
+// apply visits node, the element at iter.index of l
+func (r *rewriter) apply(parent Node, name string, iter *iterator, l list, node Node) {
+	r.applyNode(Cursor{parent: parent, name: name, iter: iter, list: l, node: node})
+}
+
+func (r *rewriter) applyField(parent Node, name string, node Node, set func(Node)) {
+	r.applyNode(Cursor{parent: parent, name: name, node: node, set: set})
+}
+
+func (r *rewriter) applyNode(c Cursor) {
+	saved := r.cursor
+	r.cursor = c
+
+	if r.pre == nil || r.pre(&r.cursor) {
+		if r.cursor.node != nil {
+			r.children(r.cursor.node)
+		}
+		if r.post != nil && !r.post(&r.cursor) {
+			panic(abort)
+		}
+	}
+
+	r.cursor = saved
+}
+
+func (r *rewriter) applyList(parent Node, name string, l list) {
+	iter := &iterator{}
+	for iter.index = 0; iter.index < l.len(); iter.index += iter.step {
+		iter.step = 1
+		r.apply(parent, name, iter, l, l.at(iter.index))
+	}
+}
+
+func (r *rewriter) children(node Node) {
+	switch n := node.(type) {
+	case *AST:
+		r.applyList(n, "Root", &nodeList[Node]{&n.Root})
+	case *ProdRule:
+		r.applyField(n, "Right", n.Right, func(x Node) { n.Right = as[Expr](x) })
+	case *Alternation:
+		r.applyList(n, "Alternatives", &nodeList[Expr]{&n.Alternatives})
+	case *Sequence:
+		r.applyList(n, "Items", &nodeList[Expr]{&n.Items})
+	case *Group:
+		r.applyField(n, "Expr", n.Expr, func(x Node) { n.Expr = as[Expr](x) })
+	case *Optional:
+		r.applyField(n, "Expr", n.Expr, func(x Node) { n.Expr = as[Expr](x) })
+	case *Repetition:
+		r.applyField(n, "Expr", n.Expr, func(x Node) { n.Expr = as[Expr](x) })
+	case *NotPredicate:
+		r.applyField(n, "Expr", n.Expr, func(x Node) { n.Expr = as[Expr](x) })
+	case *AndPredicate:
+		r.applyField(n, "Expr", n.Expr, func(x Node) { n.Expr = as[Expr](x) })
+	case *Range:
+		r.applyField(n, "From", n.From, func(x Node) { n.From = as[*Literal](x) })
+		r.applyField(n, "To", n.To, func(x Node) { n.To = as[*Literal](x) })
+	case *Labeled:
+		r.applyField(n, "Expr", n.Expr, func(x Node) { n.Expr = as[Expr](x) })
+	case *ActionCall:
+		r.applyField(n, "Action", n.Action, func(x Node) { n.Action = as[*Action](x) })
+	case *Action:
+		r.applyList(n, "Args", &nodeList[ActionArg]{&n.Args})
+	case *ActionList:
+		r.applyList(n, "Elems", &nodeList[ActionArg]{&n.Elems})
+	case *Literal, *CharClass, *NonTerminalRef, *CodeBlock, *ActionRef, *ActionLiteral, *BadRule, *BadExpr:
+		// Leaves
+	default:
+		panic(fmt.Sprintf("ast.Rewrite: unexpected node type %T", n))
+	}
+}
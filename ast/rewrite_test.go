@@ -0,0 +1,65 @@
+package ast_test
+
+import (
+	"gbnf/ast"
+	"gbnf/lexer"
+	"gbnf/parser"
+	"testing"
+)
+
+// Testing if Rewrite replaces, inserts and deletes nodes while walking
+func TestRewrite(t *testing.T) {
+	tree, err := parser.ParseString("<a> ::= <b> \"c\" <b>\n<b> ::= \"d\" | <a>\n<c> ::= <b>", lexer.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := ast.Rewrite(tree, func(c *ast.Cursor) bool {
+		switch n := c.Node().(type) {
+		case *ast.NonTerminalRef:
+			if n.Name.Lexeme == "b" {
+				c.Replace(&ast.NonTerminalRef{Name: lexer.NewToken("bb", n.Name.Start, n.Name.End, lexer.NonTerminalSymbol)})
+			}
+		case *ast.Literal:
+			if c.Name() == "Items" {
+				c.InsertBefore(&ast.Literal{Token: lexer.NewToken("before", n.Pos(), n.Pos(), lexer.TerminalSymbol)})
+				c.InsertAfter(&ast.Literal{Token: lexer.NewToken("after", n.End(), n.End(), lexer.TerminalSymbol)})
+			}
+		case *ast.ProdRule:
+			if n.Left.Lexeme == "c" {
+				c.Delete()
+				return false
+			}
+		}
+		return true
+	}, nil)
+
+	expected := "<a> ::= <bb> \"before\" \"c\" \"after\" <bb>\n<b> ::= \"d\" | <a>"
+	if result != tree || tree.String() != expected {
+		t.Fatalf("Expected\n%s\ngot\n%s", expected, tree)
+	}
+
+	// Stopping in post and replacing the root
+	visited := 0
+	result = ast.Rewrite(tree, nil, func(c *ast.Cursor) bool {
+		visited++
+		if _, ok := c.Node().(*ast.NonTerminalRef); ok {
+			return false
+		}
+		return true
+	})
+	if visited != 1 || result != tree {
+		t.Fatalf("Expected the rewrite to stop at the first reference, got %d nodes visited", visited)
+	}
+
+	result = ast.Rewrite(tree.Root[0], func(c *ast.Cursor) bool {
+		if c.Parent() == nil {
+			c.Replace(tree.Root[1])
+			return false
+		}
+		return true
+	}, nil)
+	if result != tree.Root[1] {
+		t.Fatalf("Expected the root to be replaced, got %s", result)
+	}
+}
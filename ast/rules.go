@@ -0,0 +1,161 @@
+package ast
+
+import "fmt"
+
+type ErrAST string
+
+const (
+	ErrDuplicateRule ErrAST = "rule already defined"
+	ErrUndefinedRule ErrAST = "extension of an undefined rule"
+	ErrJSONVersion   ErrAST = "unsupported version of the JSON encoding"
+	ErrInvalidJSON   ErrAST = "invalid JSON encoding of a tree"
+)
+
+func (e ErrAST) Error() string {
+	return string(e)
+}
+
+func (e ErrAST) String() string {
+	return string(e)
+}
+
+// RuleError is a rule that couldn't be indexed: a second definition of a name, or an extension
+// of a name that isn't defined before it
+type RuleError struct {
+	Err  error
+	Name string
+	// Rule is the offending definition
+	Rule *ProdRule
+	// Prev is the first definition of the name, nil for an undefined rule
+	Prev *ProdRule
+	// Names of the files of the rules, filled in by parsers that know them
+	Filename     string
+	PrevFilename string
+}
+
+func (e *RuleError) Error() string {
+	msg := fmt.Sprintf("%s: <%s>: %s", e.Rule.Pos(), e.Name, e.Err)
+	if e.Filename != "" {
+		msg = e.Filename + ":" + msg
+	}
+	if e.Prev != nil {
+		prev := e.Prev.Pos().String()
+		if e.PrevFilename != "" {
+			prev = e.PrevFilename + ":" + prev
+		}
+		msg += " at " + prev
+	}
+
+	return msg
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// Rule is a name of the grammar with the rules defining it
+type Rule struct {
+	Name string
+	// Definition is the rule defining the name with "::="
+	Definition *ProdRule
+	// Extensions are the rules adding alternatives with "|=", in declaration order
+	Extensions []*ProdRule
+}
+
+// Alternatives returns the alternatives of the definition followed by the ones of each extension
+func (r *Rule) Alternatives() []Expr {
+	alts := alternatives(r.Definition.Right)
+	for _, ext := range r.Extensions {
+		alts = append(alts, alternatives(ext.Right)...)
+	}
+
+	return alts
+}
+
+// Expr returns the right side of the rule with its extensions merged in
+func (r *Rule) Expr() Expr {
+	if len(r.Extensions) == 0 {
+		return r.Definition.Right
+	}
+
+	return &Alternation{Alternatives: r.Alternatives()}
+}
+
+func alternatives(expr Expr) []Expr {
+	if alt, ok := expr.(*Alternation); ok {
+		return append([]Expr(nil), alt.Alternatives...)
+	}
+
+	return []Expr{expr}
+}
+
+// RuleTable indexes the rules of a tree by name, in declaration order
+type RuleTable struct {
+	rules  []*Rule
+	byName map[string]*Rule
+}
+
+// NewRuleTable indexes the rules among nodes. The first definition of a name wins, later ones
+// and extensions of names not defined yet are left out and reported
+func NewRuleTable(nodes []Node) (*RuleTable, []*RuleError) {
+	t := &RuleTable{
+		rules:  make([]*Rule, 0),
+		byName: make(map[string]*Rule),
+	}
+	var errs []*RuleError
+
+	for _, node := range nodes {
+		def, ok := node.(*ProdRule)
+		if !ok {
+			continue
+		}
+
+		name := def.Left.Lexeme
+		rule := t.byName[name]
+		switch {
+		case def.IsExtension() && rule == nil:
+			errs = append(errs, &RuleError{Err: ErrUndefinedRule, Name: name, Rule: def})
+		case def.IsExtension():
+			rule.Extensions = append(rule.Extensions, def)
+		case rule != nil:
+			errs = append(errs, &RuleError{Err: ErrDuplicateRule, Name: name, Rule: def, Prev: rule.Definition})
+		default:
+			rule = &Rule{Name: name, Definition: def}
+			t.rules = append(t.rules, rule)
+			t.byName[name] = rule
+		}
+	}
+
+	return t, errs
+}
+
+// Lookup returns the rule of a name, nil if it isn't defined
+func (t *RuleTable) Lookup(name string) *Rule {
+	return t.byName[name]
+}
+
+// Rules returns the rules in declaration order
+func (t *RuleTable) Rules() []*Rule {
+	return t.rules
+}
+
+func (t *RuleTable) Len() int {
+	return len(t.rules)
+}
+
+// Index builds the rule table of the tree, it must be called again after the rules are changed
+func (a *AST) Index() []*RuleError {
+	var errs []*RuleError
+	a.Rules, errs = NewRuleTable(a.Root)
+
+	return errs
+}
+
+// Rule returns the rule of a name, the tree is indexed first if it wasn't yet
+func (a *AST) Rule(name string) *Rule {
+	if a.Rules == nil {
+		a.Index()
+	}
+
+	return a.Rules.Lookup(name)
+}
@@ -0,0 +1,78 @@
+package ast
+
+import "fmt"
+
+// Visitor's Visit is called by Walk for each node. If the returned visitor w is not nil,
+// Walk visits the children of the node with w, then calls w.Visit(nil)
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses a tree in depth-first order: it starts by calling v.Visit(node), and walks the
+// children of node with the visitor returned, unless it's nil. Tokens aren't nodes, they're not visited
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case *AST:
+		for _, rule := range n.Root {
+			Walk(v, rule)
+		}
+	case *ProdRule:
+		Walk(v, n.Right)
+	case *Alternation:
+		walkList(v, n.Alternatives)
+	case *Sequence:
+		walkList(v, n.Items)
+	case *Group:
+		Walk(v, n.Expr)
+	case *Optional:
+		Walk(v, n.Expr)
+	case *Repetition:
+		Walk(v, n.Expr)
+	case *NotPredicate:
+		Walk(v, n.Expr)
+	case *AndPredicate:
+		Walk(v, n.Expr)
+	case *Range:
+		Walk(v, n.From)
+		Walk(v, n.To)
+	case *Labeled:
+		Walk(v, n.Expr)
+	case *ActionCall:
+		Walk(v, n.Action)
+	case *Action:
+		walkList(v, n.Args)
+	case *ActionList:
+		walkList(v, n.Elems)
+	case *Literal, *CharClass, *NonTerminalRef, *CodeBlock, *ActionRef, *ActionLiteral, *BadRule, *BadExpr:
+		// Leaves
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+
+	v.Visit(nil)
+}
+
+func walkList[T Node](v Visitor, list []T) {
+	for _, node := range list {
+		Walk(v, node)
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses a tree in depth-first order: it calls f(node) and walks the children of node
+// if f returns true, then calls f(nil)
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
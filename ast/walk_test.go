@@ -0,0 +1,78 @@
+package ast_test
+
+import (
+	"fmt"
+	"gbnf/ast"
+	"gbnf/lexer"
+	"gbnf/parser"
+	"strings"
+	"testing"
+)
+
+type recorder struct {
+	nodes []string
+	depth int
+}
+
+func (r *recorder) Visit(node ast.Node) ast.Visitor {
+	if node == nil {
+		r.depth--
+		return nil
+	}
+	r.nodes = append(r.nodes, fmt.Sprintf("%*s%T", r.depth*2, "", node))
+	r.depth++
+	return r
+}
+
+// Testing if Walk and Inspect visit every node in depth-first order
+func TestWalk(t *testing.T) {
+	tree, err := parser.ParseString("<a> ::= x=<b> \"c\"* | [d] { Fn(x, [1]) }\n<e> ::= \"f\" ... \"g\"", lexer.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &recorder{}
+	ast.Walk(r, tree)
+	expected := []string{
+		"*ast.AST",
+		"  *ast.ProdRule",
+		"    *ast.Alternation",
+		"      *ast.Sequence",
+		"        *ast.Labeled",
+		"          *ast.NonTerminalRef",
+		"        *ast.Repetition",
+		"          *ast.Literal",
+		"      *ast.Sequence",
+		"        *ast.Optional",
+		"          *ast.Literal",
+		"        *ast.ActionCall",
+		"          *ast.Action",
+		"            *ast.ActionRef",
+		"            *ast.ActionList",
+		"              *ast.ActionLiteral",
+		"  *ast.ProdRule",
+		"    *ast.Range",
+		"      *ast.Literal",
+		"      *ast.Literal",
+	}
+	if strings.Join(r.nodes, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(r.nodes, "\n"))
+	}
+	if r.depth != 0 {
+		t.Fatalf("Expected a Visit(nil) for every node walked, got %d missing", r.depth)
+	}
+
+	literals := 0
+	ast.Inspect(tree, func(node ast.Node) bool {
+		switch node.(type) {
+		case *ast.Literal:
+			literals++
+		case *ast.Range:
+			return false
+		}
+		return true
+	})
+	if literals != 2 {
+		t.Fatalf("Expected 2 literals outside of ranges, got %d", literals)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Lines of context around the changes of a hunk
+const diffContext = 3
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line []byte
+	// Indexes of the line in the old and the new text
+	old, new int
+}
+
+// unifiedDiff returns the changes from a to b in the unified format, nothing if they're equal
+func unifiedDiff(nameA, nameB string, a, b []byte) []byte {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+	for start := 0; start < len(ops); {
+		// A hunk spans the changes less than twice the context apart, plus the context around them
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		end := first
+		for i := first; i < len(ops); i++ {
+			if ops[i].kind != ' ' {
+				end = i + 1
+			} else if i-end >= 2*diffContext {
+				break
+			}
+		}
+		from := max(first-diffContext, start)
+		to := min(end+diffContext, len(ops))
+
+		writeHunk(&out, ops[from:to])
+		start = to
+	}
+
+	return out.Bytes()
+}
+
+func writeHunk(out *bytes.Buffer, ops []diffOp) {
+	oldCount, newCount := 0, 0
+	for _, op := range ops {
+		if op.kind != '+' {
+			oldCount++
+		}
+		if op.kind != '-' {
+			newCount++
+		}
+	}
+
+	// An empty range starts at the line before it
+	oldStart, newStart := ops[0].old, ops[0].new
+	if oldCount > 0 {
+		oldStart++
+	}
+	if newCount > 0 {
+		newStart++
+	}
+
+	fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+	for _, op := range ops {
+		out.WriteByte(op.kind)
+		out.Write(op.line)
+		if !bytes.HasSuffix(op.line, []byte("\n")) {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// splitLines splits text after each newline, the last line may not end with one
+func splitLines(text []byte) [][]byte {
+	lines := make([][]byte, 0, bytes.Count(text, []byte("\n"))+1)
+	for len(text) > 0 {
+		i := bytes.IndexByte(text, '\n') + 1
+		if i == 0 {
+			i = len(text)
+		}
+		lines = append(lines, text[:i])
+		text = text[i:]
+	}
+
+	return lines
+}
+
+// diffLines returns the edit script from a to b through their longest common subsequence of
+// lines. The common prefix and suffix are set apart first, formatting rarely touches every line
+func diffLines(a, b [][]byte) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && bytes.Equal(a[prefix], b[prefix]) {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && bytes.Equal(a[len(a)-1-suffix], b[len(b)-1-suffix]) {
+		suffix++
+	}
+	x, y := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if bytes.Equal(x[i], y[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{kind: ' ', line: a[i], old: i, new: i})
+	}
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && bytes.Equal(x[i], y[j]):
+			ops = append(ops, diffOp{kind: ' ', line: x[i], old: prefix + i, new: prefix + j})
+			i++
+			j++
+		case j == len(y) || i < len(x) && lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{kind: '-', line: x[i], old: prefix + i, new: prefix + j})
+			i++
+		default:
+			ops = append(ops, diffOp{kind: '+', line: y[j], old: prefix + i, new: prefix + j})
+			j++
+		}
+	}
+	for k := 0; k < suffix; k++ {
+		ops = append(ops, diffOp{kind: ' ', line: a[len(a)-suffix+k], old: len(a) - suffix + k, new: len(b) - suffix + k})
+	}
+
+	return ops
+}
@@ -0,0 +1,550 @@
+// Package format prints grammars in a canonical layout, so the way a grammar reads doesn't
+// depend on who wrote it
+package format
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gbnf/ast"
+	"gbnf/lexer"
+	"gbnf/parser"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type ErrFormat string
+
+const (
+	ErrBadNode ErrFormat = "can't format a rule that wasn't parsed"
+	ErrNoOr    ErrFormat = "can't format alternatives in a dialect without an operator for them"
+)
+
+func (e ErrFormat) Error() string {
+	return string(e)
+}
+
+func (e ErrFormat) String() string {
+	return string(e)
+}
+
+// Source parses src, a grammar in the dialect of opts, and returns it formatted, see Fprint.
+// Rules defined twice don't stop the formatting, syntax errors do
+func Source(src []byte, opts lexer.Options) ([]byte, error) {
+	opts.CommentsAsTrivia = false
+	opts.Recover = true
+
+	tree, err := parser.ParseWithOptions(bytes.NewReader(src), opts)
+	if err != nil {
+		var errs parser.ErrorList
+		if !errors.As(err, &errs) {
+			return nil, err
+		}
+		for _, e := range errs {
+			var rerr *ast.RuleError
+			if !errors.As(e, &rerr) {
+				return nil, err
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Fprint(&buf, tree, opts.Dialect); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Fprint writes tree to w in the notation of d, Default if nil. The layout is canonical:
+//
+//   - the rule operators of consecutive rules are aligned, a blank line starts a new block
+//   - each alternative of a rule is on a line of its own, led by "|"
+//   - terminals are double quoted, labels are glued to their "=", x=<expr>
+//   - the items of a sequence are split by the separator of d if it has one, x, y
+//   - actions are written { Name(arg, arg) }
+//
+// The comments of tree.Comments are kept with the alternative they're in, after the item they
+// follow. A line comment ends its line, the rest of the alternative goes on the next one. The
+// comments between rules stay on lines of their own, with at most one blank line between rules.
+// tree must come from a single source and have no BadRule or BadExpr, and it can only have
+// alternatives if d has an Or operator
+func Fprint(w io.Writer, tree *ast.AST, d *lexer.Dialect) error {
+	if d == nil {
+		d = lexer.Default
+	}
+
+	rules := make([]*ast.ProdRule, len(tree.Root))
+	for i, node := range tree.Root {
+		rule, ok := node.(*ast.ProdRule)
+		if !ok {
+			return fmt.Errorf("%s: %w", node.Pos(), ErrBadNode)
+		}
+		if _, ok := rule.Right.(*ast.BadExpr); ok {
+			return fmt.Errorf("%s: %w", rule.Pos(), ErrBadNode)
+		}
+		rules[i] = rule
+		if len(d.Or) == 0 {
+			if pos, ok := findAlternation(rule); ok {
+				return fmt.Errorf("%s: %w", pos, ErrNoOr)
+			}
+		}
+	}
+
+	p := &printer{dialect: d, comments: tree.Comments}
+	widths := p.widths(rules)
+	for i, rule := range rules {
+		p.comment(rule.Pos().Offset)
+		limit := -1
+		if i+1 < len(rules) {
+			limit = rules[i+1].Pos().Offset
+		}
+		p.rule(rule, widths[i], limit)
+	}
+	p.comment(-1)
+	if p.buf.Len() > 0 {
+		p.buf.WriteByte('\n')
+	}
+
+	_, err := w.Write(p.buf.Bytes())
+	return err
+}
+
+// findAlternation returns the position of the first alternation of rule, if it has any
+func findAlternation(rule *ast.ProdRule) (lexer.Position, bool) {
+	var pos lexer.Position
+	found := false
+	ast.Inspect(rule, func(node ast.Node) bool {
+		if alt, ok := node.(*ast.Alternation); ok && !found {
+			pos, found = alt.Pos(), true
+		}
+		return !found
+	})
+
+	return pos, found
+}
+
+type printer struct {
+	dialect *lexer.Dialect
+	buf     bytes.Buffer
+	// Comments not printed yet, in order
+	comments []*lexer.Token
+	// Last source line printed, blank lines are kept between rules and comments
+	line uint
+}
+
+// widths returns the width the name of each rule is padded to: the widest name of its block,
+// blocks being separated by blank lines
+func (p *printer) widths(rules []*ast.ProdRule) []int {
+	widths := make([]int, len(rules))
+	start := 0
+	for i := 1; i <= len(rules); i++ {
+		if i < len(rules) && !p.blankBetween(rules[i-1], rules[i]) {
+			continue
+		}
+
+		max := 0
+		for _, rule := range rules[start:i] {
+			if n := utf8.RuneCountInString(p.name(rule.Left)); n > max {
+				max = n
+			}
+		}
+		for j := start; j < i; j++ {
+			widths[j] = max
+		}
+		start = i
+	}
+
+	return widths
+}
+
+// blankBetween reports whether there's a blank line between two rules, the lines of the
+// comments between them aren't blank
+func (p *printer) blankBetween(prev, rule *ast.ProdRule) bool {
+	from, to := prev.End(), rule.Pos()
+	line := endLine(prev)
+
+	i := sort.Search(len(p.comments), func(i int) bool { return p.comments[i].Start.Offset >= from.Offset })
+	for ; i < len(p.comments) && p.comments[i].Start.Offset < to.Offset; i++ {
+		c := p.comments[i]
+		if c.Start.Line <= line {
+			continue
+		}
+		if c.Start.Line > line+1 {
+			return true
+		}
+		line = c.End.Line
+	}
+
+	return to.Line > line+1
+}
+
+// newline starts the output line of the source line, after a blank line if the source has one
+func (p *printer) newline(line uint) {
+	if p.buf.Len() == 0 {
+		return
+	}
+
+	p.buf.WriteByte('\n')
+	if line > p.line+1 {
+		p.buf.WriteByte('\n')
+	}
+}
+
+// comment prints the comments before offset on lines of their own, all of them if offset is negative
+func (p *printer) comment(offset int) {
+	for len(p.comments) > 0 && (offset < 0 || p.comments[0].Start.Offset < offset) {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+
+		p.newline(c.Start.Line)
+		p.buf.WriteString(commentText(c))
+		p.line = c.End.Line
+	}
+}
+
+// rule prints a rule with its name padded to width and the comments up to limit, the start of the
+// next rule or -1
+func (p *printer) rule(rule *ast.ProdRule, width, limit int) {
+	name := p.name(rule.Left)
+	op := rule.Define.Raw
+	p.newline(rule.Pos().Line)
+
+	// Column of the alternatives, the "|" leading the next ones ends right before it
+	column := width + 1 + utf8.RuneCountInString(op) + 1
+	indent := strings.Repeat(" ", column)
+
+	alts := []ast.Expr{rule.Right}
+	var ors []*lexer.Token
+	if alt, ok := rule.Right.(*ast.Alternation); ok {
+		alts = alt.Alternatives
+		ors = operators(alt)
+	}
+
+	line := rule.Define.End.Line
+	for i, alt := range alts {
+		// An empty alternative is on the line of the operator before it
+		if end := alt.End(); end.IsValid() {
+			line = end.Line
+		} else if i > 0 && ors != nil {
+			line = ors[i-1].End.Line
+		}
+
+		// The comments of an alternative run up to the operator after it, or the next
+		// alternative that isn't empty when the operators are unknown
+		stop := rule.End().Offset
+		if i+1 < len(alts) && ors != nil {
+			stop = ors[i].Start.Offset
+		} else {
+			for _, next := range alts[i+1:] {
+				if pos := next.Pos(); pos.IsValid() {
+					stop = pos.Offset
+					break
+				}
+			}
+		}
+		last := i == len(alts)-1
+		if last && rule.EndOfRule != nil {
+			line = rule.EndOfRule.End.Line
+		}
+
+		// A comment stays after the item it follows, the ones before the first item stay after
+		// the "|" and the ones on the lines below the alternative stay below it
+		items := sequenceItems(alt)
+		follow := make([][]*lexer.Token, len(items))
+		var lead, trailing, after []*lexer.Token
+		for len(p.comments) > 0 {
+			c := p.comments[0]
+			if c.Start.Offset >= stop {
+				// A comment on the line ending the rule is the last one of the rule
+				if !last || c.Start.Line > line || limit >= 0 && c.Start.Offset >= limit {
+					break
+				}
+			}
+			p.comments = p.comments[1:]
+
+			k := len(items) - 1
+			for k >= 0 && items[k].Pos().Offset > c.Start.Offset {
+				k--
+			}
+			switch {
+			case k < 0 && (len(items) > 0 || c.Start.Line <= line):
+				lead = append(lead, c)
+			case c.Start.Line > line:
+				after = append(after, c)
+			case k == len(items)-1:
+				trailing = append(trailing, c)
+			default:
+				follow[k] = append(follow[k], c)
+			}
+		}
+
+		if i == 0 {
+			p.buf.WriteString(name)
+			p.buf.WriteString(strings.Repeat(" ", width-utf8.RuneCountInString(name)+1))
+			p.buf.WriteString(op)
+		} else {
+			p.buf.WriteString(p.leader(column))
+		}
+		// Text after a line comment goes on the next line, in the column of the alternatives
+		broken := false
+		write := func(text string) {
+			if broken {
+				p.buf.WriteByte('\n')
+				p.buf.WriteString(indent)
+			} else {
+				p.buf.WriteByte(' ')
+			}
+			p.buf.WriteString(text)
+			broken = false
+		}
+		comment := func(c *lexer.Token) {
+			write(commentText(c))
+			broken = !p.isBlockComment(c)
+		}
+
+		for _, c := range lead {
+			comment(c)
+		}
+		for k, item := range items {
+			text := p.expr(item)
+			if k < len(items)-1 {
+				text += p.separator()
+			}
+			write(text)
+			for _, c := range follow[k] {
+				comment(c)
+			}
+		}
+		if last && rule.EndOfRule != nil {
+			write(rule.EndOfRule.Raw)
+		}
+		for _, c := range trailing {
+			comment(c)
+		}
+		for _, c := range after {
+			p.buf.WriteByte('\n')
+			p.buf.WriteString(indent)
+			p.buf.WriteString(commentText(c))
+		}
+
+		if last {
+			break
+		}
+		p.buf.WriteByte('\n')
+	}
+
+	p.line = endLine(rule)
+	if line > p.line {
+		p.line = line
+	}
+}
+
+// sequenceItems returns the items of a sequence, none for an empty one, or expr alone
+func sequenceItems(expr ast.Expr) []ast.Expr {
+	if seq, ok := expr.(*ast.Sequence); ok {
+		return seq.Items
+	}
+
+	return []ast.Expr{expr}
+}
+
+// separator returns the separator of the items of a sequence in the dialect, "" if it has none
+func (p *printer) separator() string {
+	if len(p.dialect.Separators) == 0 {
+		return ""
+	}
+
+	return p.dialect.Separators[0]
+}
+
+// isBlockComment reports whether c is a block comment of the dialect, text can follow it on its line
+func (p *printer) isBlockComment(c *lexer.Token) bool {
+	for _, delims := range p.dialect.BlockComments {
+		if strings.HasPrefix(c.Raw, delims[0]) && strings.HasSuffix(commentText(c), delims[1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// leader returns the "|" leading an alternative, ending right before column
+func (p *printer) leader(column int) string {
+	or := p.dialect.Or[0]
+
+	return strings.Repeat(" ", max(column-utf8.RuneCountInString(or)-1, 0)) + or
+}
+
+// operators returns the operators between the alternatives of alt, nil if they don't match them,
+// like in trees that weren't parsed
+func operators(alt *ast.Alternation) []*lexer.Token {
+	if len(alt.Ors) != len(alt.Alternatives)-1 {
+		return nil
+	}
+
+	return alt.Ors
+}
+
+// endLine returns the last line of a rule. Empty alternatives with no operator to place them are
+// taken to be on lines of their own like Fprint prints them
+func endLine(rule *ast.ProdRule) uint {
+	line := rule.End().Line
+	if rule.EndOfRule != nil {
+		return line
+	}
+
+	if alt, ok := rule.Right.(*ast.Alternation); ok && operators(alt) == nil {
+		for i := len(alt.Alternatives) - 1; i >= 0 && !alt.Alternatives[i].Pos().IsValid(); i-- {
+			line++
+		}
+	}
+
+	return line
+}
+
+func (p *printer) name(token *lexer.Token) string {
+	if p.dialect.AngleNonTerminals {
+		return "<" + token.Lexeme + ">"
+	}
+	return token.Lexeme
+}
+
+func (p *printer) expr(expr ast.Expr) string {
+	switch e := expr.(type) {
+	case *ast.Alternation:
+		var b strings.Builder
+		for i, alt := range e.Alternatives {
+			text := p.expr(alt)
+			if i > 0 {
+				if b.Len() > 0 {
+					b.WriteByte(' ')
+				}
+				b.WriteString(p.dialect.Or[0])
+				if text != "" {
+					b.WriteByte(' ')
+				}
+			}
+			b.WriteString(text)
+		}
+		return b.String()
+	case *ast.Sequence:
+		items := make([]string, len(e.Items))
+		for i, item := range e.Items {
+			items[i] = p.expr(item)
+		}
+		return strings.Join(items, p.separator()+" ")
+	case *ast.Group:
+		return "(" + p.expr(e.Expr) + ")"
+	case *ast.Optional:
+		return "[" + p.expr(e.Expr) + "]"
+	case *ast.Repetition:
+		if g := e.Braced(); g != nil {
+			return "{" + p.expr(g.Expr) + "}"
+		}
+		return p.expr(e.Expr) + repeat(e.Min, e.Max)
+	case *ast.NotPredicate:
+		return "!" + p.expr(e.Expr)
+	case *ast.AndPredicate:
+		return "&" + p.expr(e.Expr)
+	case *ast.Range:
+		return quote(e.From.Token.Lexeme) + " " + e.Op.Raw + " " + quote(e.To.Token.Lexeme)
+	case *ast.Literal:
+		return quote(e.Token.Lexeme)
+	case *ast.CharClass:
+		return e.Token.Raw
+	case *ast.NonTerminalRef:
+		return p.name(e.Name)
+	case *ast.Labeled:
+		return e.Label.Raw + e.Assign.Raw + p.expr(e.Expr)
+	case *ast.ActionCall:
+		return "{ " + action(e.Action) + " }"
+	case *ast.CodeBlock:
+		if e.Token.Lexeme == "" {
+			return "{{ }}"
+		}
+		return "{{ " + e.Token.Lexeme + " }}"
+	default:
+		panic(fmt.Sprintf("format: unexpected node type %T", e))
+	}
+}
+
+func repeat(min, max int) string {
+	switch {
+	case min == 0 && max < 0:
+		return "*"
+	case min == 1 && max < 0:
+		return "+"
+	case min == 0 && max == 1:
+		return "?"
+	case max < 0:
+		return fmt.Sprintf("{%d,}", min)
+	case min == max:
+		return fmt.Sprintf("{%d}", min)
+	default:
+		return fmt.Sprintf("{%d,%d}", min, max)
+	}
+}
+
+func action(a *ast.Action) string {
+	return a.Action.Lexeme + "(" + args(a.Args) + ")"
+}
+
+func args(list []ast.ActionArg) string {
+	strs := make([]string, len(list))
+	for i, arg := range list {
+		switch a := arg.(type) {
+		case *ast.Action:
+			strs[i] = action(a)
+		case *ast.ActionRef:
+			strs[i] = a.Name.Lexeme
+		case *ast.ActionLiteral:
+			if a.Token.Type == lexer.ActionString {
+				strs[i] = quote(a.Token.Lexeme)
+			} else {
+				strs[i] = a.Token.Lexeme
+			}
+		case *ast.ActionList:
+			strs[i] = "[" + args(a.Elems) + "]"
+		default:
+			panic(fmt.Sprintf("format: unexpected node type %T", a))
+		}
+	}
+
+	return strings.Join(strs, ", ")
+}
+
+// quote double quotes s with the escape sequences the lexer reads, runes that can't be seen are escaped
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r < utf8.RuneSelf && !unicode.IsPrint(r):
+			fmt.Fprintf(&b, `\x%02X`, r)
+		case !unicode.IsPrint(r):
+			fmt.Fprintf(&b, `\u{%X}`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
+
+func commentText(c *lexer.Token) string {
+	return strings.TrimRightFunc(c.Raw, unicode.IsSpace)
+}
@@ -0,0 +1,194 @@
+package format
+
+import (
+	"bytes"
+	"errors"
+	"gbnf/lexer"
+	"gbnf/parser"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Testing if rules are aligned, alternatives split and terminals, labels and actions normalized
+func TestSource(t *testing.T) {
+	src := "<expr>::=<term> '+' <expr>|<term>\n<term> ::= x = NAME {Name(x,'a',[1, y])}   !!\n"
+
+	out, err := Source([]byte(src), lexer.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "<expr> ::= <term> \"+\" <expr>\n" +
+		"         | <term>\n" +
+		"<term> ::= x=\"NAME\" { Name(x, \"a\", [1, y]) } !!\n"
+	if string(out) != expected {
+		t.Fatalf("Expected\n%s\ngot\n%s", expected, out)
+	}
+}
+
+// Testing if comments and blank lines between rules are kept
+func TestSource_Comments(t *testing.T) {
+	src := "# numbers\n<digit> ::= \"0\" ... \"9\" ; a digit\n\n\n(* more *)\n<number> ::= <digit> # one\n | <digit> <number>\n# last\n"
+
+	out, err := Source([]byte(src), lexer.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "# numbers\n<digit> ::= \"0\" ... \"9\" ; a digit\n\n(* more *)\n" +
+		"<number> ::= <digit> # one\n" +
+		"           | <digit> <number>\n" +
+		"# last\n"
+	if string(out) != expected {
+		t.Fatalf("Expected\n%s\ngot\n%s", expected, out)
+	}
+}
+
+// Testing if formatting a formatted grammar changes nothing
+func TestSource_Idempotent(t *testing.T) {
+	tests := []struct {
+		dialect *lexer.Dialect
+		src     string
+	}{
+		{nil, "<a> ::= x # c1\n y # c2\n\n<b> ::= | <a> # c3\n # c4\n | z (* c5 *) # c6\n  | \n"},
+		{nil, "<a> ::= # why\n  x\n  | y (* b *) z !! # end\n<long> ::= <a>\n"},
+		{nil, "<a> ::= (x|y|) [z]{2,3} &<b> !<c>* {{ return nil }}\n<a> |= \"\\t\\\"\"\n"},
+		{lexer.EBNF, "expr = term, { \"+\", term } ;\nterm=factor,(\"*\",factor)*|factor;\n"},
+		{nil, "<a> ::= | | # c\n <b> (* k *) x # end\n"},
+	}
+
+	for _, test := range tests {
+		opts := lexer.Options{Dialect: test.dialect}
+		once, err := Source([]byte(test.src), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		twice, err := Source(once, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(once, twice) {
+			t.Fatalf("Expected\n%s\ngot\n%s", once, twice)
+		}
+	}
+}
+
+// Testing if formatting the grammars of the parser's testdata a second time changes nothing
+func TestSource_IdempotentCorpus(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("..", "parser", "testdata", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("Expected grammars in the parser's testdata")
+	}
+
+	dialects := map[string]*lexer.Dialect{}
+	for _, d := range []*lexer.Dialect{lexer.Default, lexer.BNF, lexer.EBNF, lexer.PEG, lexer.GBNF} {
+		dialects["."+d.Name] = d
+	}
+	for _, path := range paths {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := lexer.Options{Dialect: dialects[filepath.Ext(path)], Filename: path}
+		once, err := Source(src, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		twice, err := Source(once, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(once, twice) {
+			t.Fatalf("%s: expected\n%s\ngot\n%s", path, once, twice)
+		}
+	}
+}
+
+// Testing if comments stay after the item they follow, in the alternative they're in
+func TestSource_CommentsInAlternatives(t *testing.T) {
+	src := "<a> ::= | | # c\n <b> (* k *) x # end\n<b> ::= x # one\n  # two\n | # three\n | y\n"
+
+	out, err := Source([]byte(src), lexer.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "<a> ::=\n" +
+		"      |\n" +
+		"      | # c\n" +
+		"        <b> (* k *) \"x\" # end\n" +
+		"<b> ::= \"x\" # one\n" +
+		"        # two\n" +
+		"      | # three\n" +
+		"      | \"y\"\n"
+	if string(out) != expected {
+		t.Fatalf("Expected\n%s\ngot\n%s", expected, out)
+	}
+}
+
+// Testing if grammars are printed in their dialect
+func TestSource_Dialect(t *testing.T) {
+	tests := []struct {
+		dialect  *lexer.Dialect
+		src      string
+		expected string
+	}{
+		{lexer.GBNF, "root::=item (\",\" item)*\nitem ::= [a-z]+|\"\\u00A0\"", "root ::= item (\",\" item)*\nitem ::= [a-z]+\n       | \"\\u{A0}\"\n"},
+		{lexer.PEG, "Expr <- Term (\"+\" Term)* / Term", "Expr <- Term (\"+\" Term)*\n      / Term\n"},
+		{lexer.EBNF, "expr = term, (\"+\", term)* ;", "expr = term, (\"+\", term)* ;\n"},
+		{lexer.EBNF, "expr = term, { \"+\", term } ;", "expr = term, {\"+\", term} ;\n"},
+	}
+
+	for _, test := range tests {
+		out, err := Source([]byte(test.src), lexer.Options{Dialect: test.dialect})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != test.expected {
+			t.Fatalf("Expected\n%s\ngot\n%s", test.expected, out)
+		}
+	}
+}
+
+// Testing if trees with broken rules are refused
+func TestFprint_BadNode(t *testing.T) {
+	tree, _ := parser.ParseString("<a> ::= (\n<b> ::= x", lexer.Options{Recover: true})
+
+	err := Fprint(&bytes.Buffer{}, tree, nil)
+	if !errors.Is(err, ErrBadNode) {
+		t.Fatalf("Expected %v, got %v", ErrBadNode, err)
+	}
+
+	if _, err := Source([]byte("<a> ::= (\n<b> ::= x"), lexer.Options{}); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if _, err := Source([]byte("<a> ::= x\n<a> ::= y"), lexer.Options{}); err != nil {
+		t.Fatalf("Expected no error for a duplicate rule, got %v", err)
+	}
+}
+
+// Testing if alternatives are refused in a dialect without an operator for them
+func TestFprint_NoOr(t *testing.T) {
+	dialect := *lexer.Default
+	dialect.Or = nil
+
+	tree, err := parser.ParseString("<a> ::= x\n<b> ::= (x | y)", lexer.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Fprint(&bytes.Buffer{}, tree, &dialect)
+	if !errors.Is(err, ErrNoOr) || !strings.HasPrefix(err.Error(), "2:10:") {
+		t.Fatalf("Expected %v at 2:10, got %v", ErrNoOr, err)
+	}
+
+	tree.Root = tree.Root[:1]
+	var buf bytes.Buffer
+	if err := Fprint(&buf, tree, &dialect); err != nil || buf.String() != "<a> ::= \"x\"\n" {
+		t.Fatalf("Expected the rule without alternatives, got %q, %v", buf.String(), err)
+	}
+}
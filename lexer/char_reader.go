@@ -1,45 +1,198 @@
 package lexer
 
 import (
-	"bufio"
 	"io"
+	"unicode/utf8"
+	"unsafe"
 )
 
+// CharReader reads runes from a window of the source kept in memory. Bytes are only discarded
+// once no checkpoint needs them, so the reader can be rewound to any held offset
 type CharReader struct {
-	*bufio.Reader
+	src io.Reader
+	// buf[off:] was read from src but not consumed yet, buf[0] is at offset base of the source
+	buf  []byte
+	off  int
+	base int
+	// First error returned by src, io.EOF at the end of the input
+	err error
+	// Offsets held by checkpoints
+	holds []int
+	// Offset of the first byte the owner of the reader still needs
+	pin int
+	// source is the whole input when it is in memory, buf is then the same bytes
+	source string
 	buffer [1]rune
+	// Size in bytes of the last rune read
+	width int
 }
 
+// minRead is the least free space handed to the source on each read
+const minRead = 4096
+
 func newCharReader(r io.Reader) *CharReader {
 	return &CharReader{
-		Reader: bufio.NewReader(r),
+		src:    r,
+		buf:    make([]byte, 0, minRead),
+		buffer: [1]rune{0},
+	}
+}
+
+// newStringReader returns a reader over an input that is already in memory. The window is the
+// input itself, so nothing is read, copied or discarded
+func newStringReader(src string) *CharReader {
+	return &CharReader{
+		buf:    unsafe.Slice(unsafe.StringData(src), len(src)),
+		err:    io.EOF,
+		source: src,
 		buffer: [1]rune{0},
 	}
 }
 
 func (l *CharReader) nextChar() (rune, error) {
-	r, _, err := l.ReadRune()
+	r, size, err := l.ReadRune()
 	if err != nil {
 		return 0, err
 	}
 
 	l.buffer[0] = r
+	l.width = size
 
 	return r, nil
 }
 
 func (l *CharReader) peekChar() (rune, error) {
-	r, _, err := l.ReadRune()
+	r, _, err := l.decode()
+	return r, err
+}
+
+func (l *CharReader) ReadRune() (rune, int, error) {
+	r, size, err := l.decode()
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
+	l.off += size
 
-	err = l.UnreadRune()
-	if err != nil {
-		return 0, err
+	return r, size, nil
+}
+
+// decode decodes the rune at the read position without consuming it
+func (l *CharReader) decode() (rune, int, error) {
+	if len(l.buf)-l.off < utf8.UTFMax {
+		l.fill(utf8.UTFMax)
+	}
+	if l.off == len(l.buf) {
+		return 0, 0, l.err
 	}
 
-	return r, nil
+	if b := l.buf[l.off]; b < utf8.RuneSelf {
+		return rune(b), 1, nil
+	}
+	r, size := utf8.DecodeRune(l.buf[l.off:])
+
+	return r, size, nil
+}
+
+// Peek returns the next n bytes without consuming them. If there are less than n bytes left,
+// it returns them along with the error that stopped the reader
+func (l *CharReader) Peek(n int) ([]byte, error) {
+	if l.off+n <= len(l.buf) {
+		return l.buf[l.off : l.off+n], nil
+	}
+
+	l.fill(n)
+	if len(l.buf)-l.off < n {
+		return l.buf[l.off:], l.err
+	}
+
+	return l.buf[l.off : l.off+n], nil
+}
+
+// Buffered returns the number of bytes that can be peeked without reading from the source
+func (l *CharReader) Buffered() int {
+	return len(l.buf) - l.off
+}
+
+// fill reads from the source until n bytes are buffered or the source fails
+func (l *CharReader) fill(n int) {
+	for empty := 0; len(l.buf)-l.off < n && l.err == nil; {
+		l.compact()
+		if cap(l.buf)-len(l.buf) < minRead {
+			buf := make([]byte, len(l.buf), 2*cap(l.buf)+minRead)
+			copy(buf, l.buf)
+			l.buf = buf
+		}
+
+		m, err := l.src.Read(l.buf[len(l.buf):cap(l.buf)])
+		l.buf = l.buf[:len(l.buf)+m]
+		if err != nil {
+			l.err = err
+		}
+
+		// Like bufio, give up on sources that keep returning nothing
+		if empty++; m > 0 {
+			empty = 0
+		} else if empty == 100 {
+			l.err = io.ErrNoProgress
+		}
+	}
+}
+
+// compact discards the consumed bytes no checkpoint holds, when they're worth moving the rest
+func (l *CharReader) compact() {
+	keep := min(l.off, l.pin-l.base)
+	for _, offset := range l.holds {
+		keep = min(keep, offset-l.base)
+	}
+	if keep < minRead || keep < len(l.buf)/2 {
+		return
+	}
+
+	n := copy(l.buf, l.buf[keep:])
+	l.buf = l.buf[:n]
+	l.off -= keep
+	l.base += keep
+}
+
+// text returns the input between two offsets that are still in the window. For inputs in memory
+// it's a substring of the input, otherwise it's copied from the window
+func (l *CharReader) text(from, to int) string {
+	if from == to {
+		return ""
+	}
+	if l.source != "" {
+		return l.source[from:to]
+	}
+
+	return string(l.buf[from-l.base : to-l.base])
+}
+
+// window returns the bytes between two offsets that are still in the window
+func (l *CharReader) window(from, to int) []byte {
+	return l.buf[from-l.base : to-l.base]
+}
+
+// offset returns the offset in the source of the next byte to be read
+func (l *CharReader) offset() int {
+	return l.base + l.off
+}
+
+// seek moves the read position back to an offset that is still in the window
+func (l *CharReader) seek(offset int) {
+	l.off = offset - l.base
+}
+
+func (l *CharReader) hold(offset int) {
+	l.holds = append(l.holds, offset)
+}
+
+func (l *CharReader) release(offset int) {
+	for i := len(l.holds) - 1; i >= 0; i-- {
+		if l.holds[i] == offset {
+			l.holds = append(l.holds[:i], l.holds[i+1:]...)
+			return
+		}
+	}
 }
 
 type ErrCharReader string
@@ -48,6 +201,11 @@ const (
 	ErrCharReaderZeroBytes ErrCharReader = "zero bytes read"
 	ErrUnexpectedRune      ErrCharReader = "unexpected rune"
 	ErrCondFailed          ErrCharReader = "condition failed"
+	ErrUnexpectedEOF       ErrCharReader = "unexpected end of input"
+	ErrInvalidEscape       ErrCharReader = "invalid escape sequence"
+	ErrInvalidClass        ErrCharReader = "invalid character class"
+	ErrInvalidRepetition   ErrCharReader = "invalid repetition bounds"
+	ErrUnterminatedString  ErrCharReader = "unterminated string"
 )
 
 func (e ErrCharReader) Error() string {
@@ -94,10 +252,13 @@ func advanceIfChar(l *Lexer, f func(r rune) bool) error {
 
 func expectChar(l *Lexer, r rune) error {
 	if r1, err := l.peekChar(); err != nil {
+		if err == io.EOF {
+			return l.newError(ErrUnexpectedEOF, EOF, r)
+		}
 		return err
 	} else {
 		if r1 != r {
-			return ErrUnexpectedRune
+			return l.newError(ErrUnexpectedRune, r1, r)
 		}
 	}
 
@@ -122,6 +283,11 @@ func advanceCharN(l *Lexer, n int) error {
 	return nil
 }
 
+// advanceOperator consumes the runes of op, which the caller already matched
+func advanceOperator(l *Lexer, op string) error {
+	return advanceCharN(l, utf8.RuneCountInString(op))
+}
+
 func advanceClr(l *Lexer) error {
 	if err := advanceChar(l); err != nil {
 		return err
@@ -136,24 +302,31 @@ func expectCond(l *Lexer, r rune) error {
 		return err
 	} else {
 		if r1 != r {
-			return ErrCondFailed
+			return l.newError(ErrCondFailed, r1, r)
 		}
 	}
 
 	return nil
 }
 
+// hasPrefix reports whether the unread input starts with s, without consuming it
+func hasPrefix(l *Lexer, s string) bool {
+	next, _ := l.Peek(len(s))
+
+	return string(next) == s
+}
+
 func skipWhitespace(l *Lexer) error {
-	err := readNextCharWhile(l, func(r rune) bool {
-		return r == ' ' || r == '\t' || r == '\n'
-	})
+	// A byte order mark is only skipped at the start of the input
+	space := func(r rune) bool {
+		return isSpace(r) || r == bom && l.pos.Offset == 0
+	}
+	err := readNextCharWhile(l, space)
 
 	// Discard the last whitespace character
 	// In some cases the next character isn't a whitespace character,
 	// for instance if there's only one space character, so we check it before discarding it
-	err = advanceIfChar(l, func(r rune) bool {
-		return r == ' ' || r == '\t' || r == '\n'
-	})
+	err = advanceIfChar(l, space)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,174 @@
+package lexer
+
+import (
+	"strings"
+	"unicode"
+)
+
+// CharRange is an inclusive range of runes, a single rune has Lo == Hi.
+// The bounds are kept as they were written, so a reversed range like a-Z is still valid
+type CharRange struct {
+	Lo rune
+	Hi rune
+}
+
+func (c CharRange) Contains(r rune) bool {
+	lo, hi := c.Lo, c.Hi
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+
+	return r >= lo && r <= hi
+}
+
+// UnicodeClass is a Unicode category or script, \p{L} or \P{Greek} when negated
+type UnicodeClass struct {
+	Name    string
+	Negated bool
+}
+
+func (u UnicodeClass) Contains(r rune) bool {
+	table := unicodeTable(u.Name)
+	if table == nil {
+		return false
+	}
+
+	return unicode.Is(table, r) != u.Negated
+}
+
+func unicodeTable(name string) *unicode.RangeTable {
+	if table, ok := unicode.Categories[name]; ok {
+		return table
+	}
+	if table, ok := unicode.Scripts[name]; ok {
+		return table
+	}
+
+	return nil
+}
+
+// CharSet is the parsed content of a character class token, e.g. [^a-z0-9_\p{L}]
+type CharSet struct {
+	Negated bool
+	Ranges  []CharRange
+	Classes []UnicodeClass
+}
+
+func (s *CharSet) Contains(r rune) bool {
+	found := false
+	for _, c := range s.Ranges {
+		if c.Contains(r) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		for _, c := range s.Classes {
+			if c.Contains(r) {
+				found = true
+				break
+			}
+		}
+	}
+
+	return found != s.Negated
+}
+
+func (s *CharSet) String() string {
+	var sb strings.Builder
+
+	sb.WriteByte('[')
+	if s.Negated {
+		sb.WriteByte('^')
+	}
+	for _, c := range s.Ranges {
+		writeClassRune(&sb, c.Lo)
+		if c.Hi != c.Lo {
+			sb.WriteByte('-')
+			writeClassRune(&sb, c.Hi)
+		}
+	}
+	for _, c := range s.Classes {
+		if c.Negated {
+			sb.WriteString(`\P{`)
+		} else {
+			sb.WriteString(`\p{`)
+		}
+		sb.WriteString(c.Name)
+		sb.WriteByte('}')
+	}
+	sb.WriteByte(']')
+
+	return sb.String()
+}
+
+func writeClassRune(sb *strings.Builder, r rune) {
+	switch r {
+	case '\\', ']', '[', '-', '^':
+		sb.WriteByte('\\')
+		sb.WriteRune(r)
+	case '\n':
+		sb.WriteString(`\n`)
+	case '\t':
+		sb.WriteString(`\t`)
+	case '\r':
+		sb.WriteString(`\r`)
+	default:
+		sb.WriteRune(r)
+	}
+}
+
+// BracketMode selects what an opening bracket starts
+type BracketMode uint
+
+const (
+	// BracketAuto lexes "[" as a character class when it's followed by "^", or when everything
+	// up to the closing "]" has no whitespace, quotes, angle brackets, parentheses or brackets and
+	// contains a range or an escape sequence. Otherwise it starts an optional group
+	BracketAuto BracketMode = iota
+	// BracketOptional always lexes "[" as the start of an optional group
+	BracketOptional
+	// BracketCharClass always lexes "[" as the start of a character class
+	BracketCharClass
+)
+
+// How far ahead BracketAuto looks for the closing bracket
+const classLookahead = 256
+
+func isCharClass(l *Lexer) bool {
+	switch l.Brackets {
+	case BracketOptional:
+		return false
+	case BracketCharClass:
+		return true
+	}
+
+	next, _ := l.Peek(classLookahead)
+	if len(next) < 2 {
+		return false
+	}
+	content := next[1:]
+	if content[0] == '^' {
+		return true
+	}
+
+	escaped, ranged := false, false
+	for i, b := range content {
+		if escaped {
+			escaped = false
+			continue
+		}
+		switch b {
+		case '\\':
+			escaped, ranged = true, true
+		case '-':
+			ranged = ranged || i > 0
+		case ']':
+			return i > 0 && ranged
+		case ' ', '\t', '\n', '\r', '<', '"', '\'', '(', '[', '|':
+			return false
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,196 @@
+package lexer
+
+import (
+	"io"
+	"strings"
+)
+
+// Dialect describes the surface syntax of a grammar notation. The state machine is the same
+// for every dialect, only the operators it looks for change
+type Dialect struct {
+	Name string
+	// Operators between the name of a rule and its definition, e.g. "::=" or "<-"
+	Assign []string
+	// Operators adding alternatives to a rule defined before, e.g. "|="
+	Extend []string
+	// Operators separating alternatives, e.g. "|" or "/"
+	Or []string
+	// Operators ending a rule, lexed as EndOfRule, e.g. "!!" or ";"
+	Terminators []string
+	// Separators are skipped like whitespace, e.g. the commas ISO EBNF puts between items
+	Separators []string
+	// Non-terminals are written as <name>
+	AngleNonTerminals bool
+	// Bare identifiers like expr or ws-name are non-terminals instead of terminals
+	BareNonTerminals bool
+	// Line comments run from one of these prefixes to the end of the line
+	LineComments []string
+	// Block comments, pairs of opening and closing delimiters
+	BlockComments [][2]string
+	Brackets      BracketMode
+	// Braces enclose a group repeated zero or more times, { "+", term }, instead of the semantic
+	// actions and code blocks of the other dialects
+	BraceRepetition bool
+}
+
+var (
+	// Default is the notation this package was written for: BNF with <name> non-terminals,
+	// bare terminals, "!!" ending a rule and every comment style
+	Default = &Dialect{
+		Name:              "default",
+		Assign:            []string{"::="},
+		Extend:            []string{"|="},
+		Or:                []string{"|"},
+		Terminators:       []string{"!!"},
+		AngleNonTerminals: true,
+		LineComments:      []string{"#", ";", "//"},
+		BlockComments:     [][2]string{{"(*", "*)"}},
+		Brackets:          BracketAuto,
+	}
+
+	// BNF is the classic notation, <expr> ::= <term> | <term> "+" <expr>
+	BNF = &Dialect{
+		Name:              "bnf",
+		Assign:            []string{"::="},
+		Extend:            []string{"|="},
+		Or:                []string{"|"},
+		AngleNonTerminals: true,
+		LineComments:      []string{";"},
+		Brackets:          BracketOptional,
+	}
+
+	// EBNF covers ISO and W3C style notations, expr = term, { "+", term } ;
+	EBNF = &Dialect{
+		Name:             "ebnf",
+		Assign:           []string{"::=", "=", ":"},
+		Extend:           []string{"|="},
+		Or:               []string{"|"},
+		Terminators:      []string{";"},
+		Separators:       []string{","},
+		BareNonTerminals: true,
+		LineComments:     []string{"//"},
+		BlockComments:    [][2]string{{"(*", "*)"}, {"/*", "*/"}},
+		Brackets:         BracketOptional,
+		BraceRepetition:  true,
+	}
+
+	// PEG is the parsing expression grammar notation, Expr <- Term ("+" Term)* / Term
+	PEG = &Dialect{
+		Name:             "peg",
+		Assign:           []string{"<-"},
+		Or:               []string{"/", "|"},
+		BareNonTerminals: true,
+		LineComments:     []string{"#"},
+		Brackets:         BracketCharClass,
+	}
+
+	// GBNF is the notation used by llama.cpp, root ::= expr ("," expr)*
+	GBNF = &Dialect{
+		Name:             "gbnf",
+		Assign:           []string{"::="},
+		Extend:           []string{"|="},
+		Or:               []string{"|"},
+		BareNonTerminals: true,
+		LineComments:     []string{"#"},
+		Brackets:         BracketCharClass,
+	}
+)
+
+// Options configures a Lexer built with NewLexerWithOptions
+type Options struct {
+	// Dialect defaults to Default
+	Dialect *Dialect
+	// Name of the source, only used to report errors
+	Filename string
+	// Keep going after errors, see Lexer.Recover
+	Recover bool
+	// Attach comments to tokens as trivia, see Lexer.CommentsAsTrivia
+	CommentsAsTrivia bool
+	// Unit of the columns of positions, see Lexer.Columns
+	Columns ColumnUnit
+	// Normalization of names, see Lexer.Normalize
+	Normalize func(string) string
+	// File of a FileSet the source was added to, the positions of the tokens then carry a Pos.
+	// Filename defaults to the name of the file
+	File *File
+}
+
+func NewLexerWithOptions(r io.Reader, opts Options) *Lexer {
+	return NewLexer(r).configure(opts)
+}
+
+// NewStringLexerWithOptions is NewStringLexer with options, see NewLexerWithOptions
+func NewStringLexerWithOptions(src string, opts Options) *Lexer {
+	return NewStringLexer(src).configure(opts)
+}
+
+// NewBytesLexerWithOptions is NewBytesLexer with options, see NewLexerWithOptions
+func NewBytesLexerWithOptions(src []byte, opts Options) *Lexer {
+	return NewBytesLexer(src).configure(opts)
+}
+
+func (l *Lexer) configure(opts Options) *Lexer {
+	if opts.Dialect != nil {
+		l.setDialect(opts.Dialect)
+	}
+	l.Filename = opts.Filename
+	if opts.File != nil {
+		l.file = opts.File
+		if l.Filename == "" {
+			l.Filename = opts.File.Name()
+		}
+	}
+	l.Recover = opts.Recover
+	l.CommentsAsTrivia = opts.CommentsAsTrivia
+	l.Columns = opts.Columns
+	l.Normalize = opts.Normalize
+
+	return l
+}
+
+func (l *Lexer) setDialect(d *Dialect) {
+	l.dialect = d
+	l.Brackets = d.Brackets
+
+	l.opStart = [256]bool{}
+	for _, ops := range [][]string{d.Assign, d.Extend, d.Or, d.Terminators, d.Separators, d.LineComments} {
+		for _, op := range ops {
+			if op != "" {
+				l.opStart[op[0]] = true
+			}
+		}
+	}
+	for _, delims := range d.BlockComments {
+		if delims[0] != "" {
+			l.opStart[delims[0][0]] = true
+		}
+	}
+}
+
+// mayStartOperator reports whether the unread input may start an operator of the dialect
+func (l *Lexer) mayStartOperator() bool {
+	return l.off >= len(l.buf) || l.opStart[l.buf[l.off]]
+}
+
+// matchPrefix returns the longest operator the unread input starts with, or "" if none does
+func matchPrefix(l *Lexer, ops []string) string {
+	match := ""
+	for _, op := range ops {
+		if len(op) > len(match) && hasPrefix(l, op) {
+			match = op
+		}
+	}
+
+	return match
+}
+
+// startsAny reports whether any of the operators starts with r
+func startsAny(r rune, ops []string) bool {
+	for _, op := range ops {
+		if strings.HasPrefix(op, string(r)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,145 @@
+package lexer
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// EOF is the rune reported by Error when the input ends unexpectedly
+const EOF rune = -1
+
+// Error is a lexical error located in the source.
+// It wraps one of the ErrCharReader values, so it can be checked with errors.Is
+type Error struct {
+	Err      error
+	Filename string
+	Pos      Position
+	// The offending rune, EOF if the input ended
+	Rune rune
+	// Runes that would have been accepted, empty if any other rune was expected
+	Expected []rune
+	// Name of the state the lexer was in, e.g. lexString
+	State string
+	// Text of the source line the error is on
+	Line string
+	// Unit Pos.Column is counted in
+	columns ColumnUnit
+}
+
+func (e *Error) Error() string {
+	var sb strings.Builder
+
+	if e.Filename != "" {
+		sb.WriteString(e.Filename)
+		sb.WriteByte(':')
+	}
+	fmt.Fprintf(&sb, "%s: %s %s", e.Pos, e.Err, quoteRune(e.Rune))
+	if e.State != "" {
+		fmt.Fprintf(&sb, " in %s", e.State)
+	}
+	if len(e.Expected) > 0 {
+		expected := make([]string, len(e.Expected))
+		for i, r := range e.Expected {
+			expected[i] = quoteRune(r)
+		}
+		fmt.Fprintf(&sb, ", expected %s", strings.Join(expected, " or "))
+	}
+
+	return sb.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Snippet renders the source line of the error with a caret under the offending rune
+func (e *Error) Snippet() string {
+	var sb strings.Builder
+
+	sb.WriteString(e.Line)
+	sb.WriteByte('\n')
+	// Tabs are copied so the caret lines up no matter the tab width
+	column := uint(1)
+	for line := e.Line; line != "" && column < e.Pos.Column; {
+		r, size := utf8.DecodeRuneInString(line)
+		line = line[size:]
+		column += e.columns.width(r, size)
+		if r == '\t' {
+			sb.WriteByte('\t')
+		} else {
+			sb.WriteByte(' ')
+		}
+	}
+	sb.WriteByte('^')
+
+	return sb.String()
+}
+
+func quoteRune(r rune) string {
+	if r == EOF {
+		return "EOF"
+	}
+	return strconv.QuoteRune(r)
+}
+
+// ErrorList is the list of errors collected by a Lexer in recovery mode
+type ErrorList []*Error
+
+func (e ErrorList) Error() string {
+	return SummarizeErrors(e)
+}
+
+func (e ErrorList) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+
+	return errs
+}
+
+// SummarizeErrors describes a list of errors by its first one and the number of the others
+func SummarizeErrors[E error](errs []E) string {
+	switch len(errs) {
+	case 0:
+		return "no errors"
+	case 1:
+		return errs[0].Error()
+	case 2:
+		return fmt.Sprintf("%s (and 1 more error)", errs[0])
+	}
+
+	return fmt.Sprintf("%s (and %d more errors)", errs[0], len(errs)-1)
+}
+
+// newError builds an Error located at the current position
+func (l *Lexer) newError(err error, r rune, expected ...rune) *Error {
+	return &Error{
+		Err:      err,
+		Filename: l.Filename,
+		Pos:      l.global(l.pos),
+		Rune:     r,
+		Expected: expected,
+		Line:     l.currentLine(),
+		columns:  l.Columns,
+	}
+}
+
+// currentLine returns the text of the line being lexed, the part that wasn't read yet is
+// taken from what's already buffered so no input is consumed
+func (l *Lexer) currentLine() string {
+	rest, _ := l.Peek(l.Buffered())
+	if i := bytes.IndexAny(rest, "\r\n"); i >= 0 {
+		rest = rest[:i]
+	}
+
+	line := l.text(l.lineStart, l.pos.Offset) + string(rest)
+	if l.lineStart == 0 {
+		line = strings.TrimPrefix(line, string(bom))
+	}
+
+	return line
+}
@@ -0,0 +1,230 @@
+package lexer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Pos is a compact position in a FileSet: the offset of a byte in a file plus the base of the file.
+// A Pos is a single integer, the FileSet resolves it to a file name, line and column
+type Pos int
+
+// NoPos is the zero Pos, it isn't in any file
+const NoPos Pos = 0
+
+func (p Pos) IsValid() bool {
+	return p != NoPos
+}
+
+// FileSet is a set of source files sharing one space of positions. Each file is given a range
+// of Pos values of the size of its source, ranges don't overlap so a Pos tells the file it's in
+type FileSet struct {
+	mu    sync.RWMutex
+	base  int
+	files []*File
+	// File of the last lookup, positions tend to be resolved in the same file over and over
+	last *File
+}
+
+func NewFileSet() *FileSet {
+	return &FileSet{base: 1}
+}
+
+// Base returns the base the next file added to the set gets by default
+func (s *FileSet) Base() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.base
+}
+
+// AddFile adds a file of size bytes to the set. A negative base means the base of the set.
+// It panics if base is lower than the base of the set or size is negative
+func (s *FileSet) AddFile(filename string, base, size int) *File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if base < 0 {
+		base = s.base
+	}
+	if base < s.base || size < 0 {
+		panic(fmt.Sprintf("lexer: invalid file %s with base %d and size %d", filename, base, size))
+	}
+
+	f := &File{name: filename, base: base, size: size, lines: []int{0}}
+	// One more position for the end of the file, so the EndMark has a position of its own
+	s.base = base + size + 1
+	s.files = append(s.files, f)
+	s.last = f
+
+	return f
+}
+
+// File returns the file p is in, nil if there's none
+func (s *FileSet) File(p Pos) *File {
+	if !p.IsValid() {
+		return nil
+	}
+
+	s.mu.RLock()
+	if f := s.last; f != nil && f.contains(p) {
+		s.mu.RUnlock()
+		return f
+	}
+	var f *File
+	if i := sort.Search(len(s.files), func(i int) bool { return s.files[i].base > int(p) }) - 1; i >= 0 {
+		f = s.files[i]
+	}
+	s.mu.RUnlock()
+
+	if f == nil || !f.contains(p) {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.last = f
+	s.mu.Unlock()
+
+	return f
+}
+
+// Position resolves p, the zero FilePosition is returned if p isn't in any file of the set
+func (s *FileSet) Position(p Pos) FilePosition {
+	if f := s.File(p); f != nil {
+		return f.Position(p)
+	}
+
+	return FilePosition{}
+}
+
+// Files returns the files of the set in the order they were added
+func (s *FileSet) Files() []*File {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return clone(s.files)
+}
+
+// File is a source file of a FileSet. The lexer records where lines start and which runes don't
+// take a column per byte as it reads the file, that's what positions are resolved with
+type File struct {
+	name string
+	base int
+	size int
+
+	mu sync.Mutex
+	// Offsets of the first byte of each line, in increasing order
+	lines []int
+	// Runes whose size in bytes isn't their width in columns, in increasing order of offset
+	wide []wideRune
+}
+
+type wideRune struct {
+	offset  int
+	size    int
+	columns int
+}
+
+func (f *File) Name() string {
+	return f.name
+}
+
+func (f *File) Base() int {
+	return f.base
+}
+
+func (f *File) Size() int {
+	return f.size
+}
+
+// LineCount returns the number of lines recorded so far
+func (f *File) LineCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.lines)
+}
+
+// AddLine records that a line starts at offset. Offsets that aren't past the last line are ignored,
+// so reading some text again after a Reset doesn't record its lines twice
+func (f *File) AddLine(offset int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if offset > f.lines[len(f.lines)-1] && offset <= f.size {
+		f.lines = append(f.lines, offset)
+	}
+}
+
+// addRune records a rune of size bytes at offset taking columns columns
+func (f *File) addRune(offset, size, columns int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if n := len(f.wide); n == 0 || offset > f.wide[n-1].offset {
+		f.wide = append(f.wide, wideRune{offset: offset, size: size, columns: columns})
+	}
+}
+
+// Pos returns the Pos of the byte at offset in the file. The size of the file is a valid offset,
+// it's the position of the end of the file. It panics if offset is out of the file
+func (f *File) Pos(offset int) Pos {
+	if offset < 0 || offset > f.size {
+		panic(fmt.Sprintf("lexer: offset %d out of file %s of size %d", offset, f.name, f.size))
+	}
+
+	return Pos(f.base + offset)
+}
+
+// Offset returns the offset of p in the file. It panics if p isn't in the file
+func (f *File) Offset(p Pos) int {
+	if !f.contains(p) {
+		panic(fmt.Sprintf("lexer: position %d out of file %s", p, f.name))
+	}
+
+	return int(p) - f.base
+}
+
+// Position resolves p, which must be in the file
+func (f *File) Position(p Pos) FilePosition {
+	offset := f.Offset(p)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	line := sort.Search(len(f.lines), func(i int) bool { return f.lines[i] > offset }) - 1
+	start := f.lines[line]
+
+	column := offset - start
+	i := sort.Search(len(f.wide), func(i int) bool { return f.wide[i].offset >= start })
+	for ; i < len(f.wide) && f.wide[i].offset < offset; i++ {
+		column -= f.wide[i].size - f.wide[i].columns
+	}
+
+	return FilePosition{
+		Filename: f.name,
+		Position: Position{Offset: offset, Line: uint(line) + 1, Column: uint(column) + 1, Pos: p},
+	}
+}
+
+func (f *File) contains(p Pos) bool {
+	return int(p) >= f.base && int(p) <= f.base+f.size
+}
+
+// FilePosition is a Pos resolved to its file
+type FilePosition struct {
+	Filename string
+	Position
+}
+
+func (p FilePosition) String() string {
+	if p.Filename == "" {
+		return p.Position.String()
+	}
+	if !p.IsValid() {
+		return p.Filename
+	}
+
+	return fmt.Sprintf("%s:%s", p.Filename, p.Position)
+}
@@ -0,0 +1,225 @@
+package lexer
+
+import (
+	"errors"
+	"strings"
+)
+
+// Edit replaces the bytes of the source between Start and End with Text
+type Edit struct {
+	Start int
+	End   int
+	Text  string
+}
+
+// TokenChange tells which tokens Relex replaced: the old tokens [Start, OldEnd) became the new
+// tokens [Start, NewEnd). The tokens before Start are the old ones, the tokens after the range
+// are the old ones moved to their new positions
+type TokenChange struct {
+	Start  int
+	OldEnd int
+	NewEnd int
+}
+
+var ErrInvalidEdit = errors.New("edit out of the bounds of the source")
+
+// Relex applies an edit to src and updates tokens, the full stream lexed from src with opts,
+// EndMark included. Only the text around the edit is lexed again: the lexer restarts after the
+// last token that can't be affected by the edit and stops as soon as it produces a token that
+// matches an old one in the same state, the rest of the stream is carried over.
+// It returns the new source, the new stream and the range of tokens that changed
+func Relex(src string, tokens []*Token, edit Edit, opts Options) (string, []*Token, TokenChange, error) {
+	if edit.Start < 0 || edit.Start > edit.End || edit.End > len(src) {
+		return "", nil, TokenChange{}, ErrInvalidEdit
+	}
+	newSrc := src[:edit.Start] + edit.Text + src[edit.End:]
+
+	anchor, stack := restartPoint(tokens, edit.Start)
+
+	l := NewStringLexerWithOptions(newSrc, opts)
+	l.Tokens = make([]*Token, 0)
+	updated := make([]*Token, 0, len(tokens))
+	change := TokenChange{}
+	if anchor >= 0 {
+		l.restartAfter(tokens[anchor], stack)
+		updated = append(updated, tokens[:anchor]...)
+		updated = append(updated, l.prev)
+		change.Start = anchor
+	}
+
+	// Old tokens are candidates to sync with once they're past the edit. oldStack follows the
+	// open groups of the old stream up to the candidate
+	old := anchor + 1
+	oldStack := clone(stack)
+	delta := len(edit.Text) - (edit.End - edit.Start)
+
+	for {
+		token, err := l.NextToken()
+		if err != nil {
+			return "", nil, TokenChange{}, err
+		}
+
+		for old < len(tokens) && (tokens[old].Start.Offset < edit.End || tokens[old].Start.Offset+delta < token.Start.Offset) {
+			oldStack = replayGroups(oldStack, tokens[old])
+			old++
+		}
+
+		if token.Type == EndMark {
+			updated = append(updated, token)
+			change.OldEnd, change.NewEnd = len(tokens), len(updated)
+			break
+		}
+
+		if old < len(tokens) && canRestartAfter(token) && l.actionStk.Empty() {
+			o := tokens[old]
+			after := replayGroups(clone(oldStack), o)
+			if o.Start.Offset+delta == token.Start.Offset && o.Type == token.Type && o.Raw == token.Raw &&
+				o.LeadingTrivia == token.LeadingTrivia && equalRunes(after, l.runeStk.stk) {
+				change.OldEnd, change.NewEnd = old, len(updated)
+				updated = append(updated, shiftTokens(tokens[old:], o, token)...)
+				break
+			}
+		}
+
+		updated = append(updated, token)
+	}
+
+	// The tokens lexed again before the edit are usually the same, they're narrowed out of the change
+	for change.Start < change.OldEnd && change.Start < change.NewEnd && sameToken(tokens[change.Start], updated[change.Start]) {
+		updated[change.Start] = tokens[change.Start]
+		change.Start++
+	}
+
+	return newSrc, updated, change, nil
+}
+
+// restartPoint returns the index of the last token the lexer can restart after without the edit
+// at offset changing it, and the closing runes of the groups open after it.
+// Tokens are decided looking ahead at most classLookahead bytes, so the restart point is at least
+// that far from the edit. Invalid tokens may leave the groups unbalanced, lexing then restarts
+// from the beginning
+func restartPoint(tokens []*Token, offset int) (int, []rune) {
+	anchor := -1
+	var stack, anchorStack []rune
+
+	for i, t := range tokens {
+		if t.Type == EndMark || t.End.Offset+classLookahead > offset {
+			break
+		}
+		if t.Type == Invalid {
+			return -1, nil
+		}
+
+		stack = replayGroups(stack, t)
+		if canRestartAfter(t) {
+			anchor, anchorStack = i, clone(stack)
+		}
+	}
+
+	return anchor, anchorStack
+}
+
+// canRestartAfter reports whether the lexer is back to lexToken after emitting t,
+// which isn't the case inside actions
+func canRestartAfter(t *Token) bool {
+	switch t.Type {
+	case Action, ActionArg, ActionString, ActionNumber, ActionList, ActionListEnd, ActionCallEnd, Invalid:
+		return false
+	}
+
+	return true
+}
+
+// replayGroups updates the closing runes of the open groups like lexGroup and lexEnclosedRight do
+func replayGroups(stack []rune, t *Token) []rune {
+	switch t.Type {
+	case ParenLeft:
+		return append(stack, ')')
+	case BracketLeft:
+		return append(stack, ']')
+	case BraceLeft:
+		return append(stack, '}')
+	case ParenRight, BracketRight, BraceRight:
+		if len(stack) > 0 {
+			return stack[:len(stack)-1]
+		}
+	}
+
+	return stack
+}
+
+func sameToken(a, b *Token) bool {
+	return a.Type == b.Type && a.Start == b.Start && a.End == b.End && a.Lexeme == b.Lexeme && a.Raw == b.Raw &&
+		a.LeadingTrivia == b.LeadingTrivia && a.TrailingTrivia == b.TrailingTrivia
+}
+
+func equalRunes(a, b []rune) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// restartAfter moves the lexer right after prev, a token lexed from the same source before the
+// edit, as if it had just emitted it
+func (l *Lexer) restartAfter(prev *Token, stack []rune) {
+	offset := prev.End.Offset
+
+	l.off = offset
+	l.pos = prev.End
+	l.start = prev.End
+	l.lexemeStart = offset
+	l.rawStart = offset
+	l.triviaStart = offset
+	l.lineStart = strings.LastIndexAny(l.source[:offset], "\r\n") + 1
+	l.updatePin()
+	l.runeStk.stk = append(l.runeStk.stk[:0], stack...)
+
+	// The trailing trivia of prev is lexed again, it's set on a copy
+	copied := *prev
+	copied.TrailingTrivia = ""
+	l.prev = &copied
+}
+
+// shiftTokens returns the old tokens moved to their new positions, given the old token from
+// matched the new token to
+func shiftTokens(tokens []*Token, from, to *Token) []*Token {
+	offsets := to.Start.Offset - from.Start.Offset
+	lines := int(to.Start.Line) - int(from.Start.Line)
+	columns := int(to.End.Column) - int(from.End.Column)
+	line := from.End.Line
+
+	if offsets == 0 && lines == 0 && columns == 0 {
+		to.TrailingTrivia = from.TrailingTrivia
+		return append([]*Token{to}, tokens[1:]...)
+	}
+
+	shift := func(p Position) Position {
+		p.Offset += offsets
+		if p.Pos.IsValid() {
+			p.Pos += Pos(offsets)
+		}
+		if p.Line == line {
+			p.Column = uint(int(p.Column) + columns)
+		}
+		p.Line = uint(int(p.Line) + lines)
+		return p
+	}
+
+	shifted := make([]Token, len(tokens))
+	result := make([]*Token, len(tokens))
+	for i, t := range tokens {
+		shifted[i] = *t
+		shifted[i].Start = shift(t.Start)
+		shifted[i].End = shift(t.End)
+		result[i] = &shifted[i]
+	}
+
+	return result
+}
@@ -1,117 +1,494 @@
+// Package lexer splits grammar files into tokens.
+//
+// Grammars are loaded on the startup path of the services using them, so the lexer is kept
+// byte-oriented: ASCII is scanned straight from the input without decoding, lexemes are cut out
+// of the input instead of being accumulated rune by rune, and tokens are allocated in slabs.
+// The throughput target is 25 MB/s per core for grammars held in memory with every token
+// retained, as measured by BenchmarkLexer_Bytes on a 4 MiB grammar. Lexing from an io.Reader
+// copies the text of each token once and should stay within 20% of that.
+//
+// The lexer falls short of the target for now: the benchmarks run at about 8 MB/s, whether the
+// grammar is in memory, read from an io.Reader or streamed. Most of the time goes to allocating
+// the million tokens of the grammar and to the garbage collector scanning them, a Token being
+// 144 bytes holding six pointers. Closing the gap takes a smaller Token that isn't allocated per
+// lexeme, and in-memory sources scanned directly rather than rune by rune
 package lexer
 
 import (
+	"bytes"
+	"errors"
 	"io"
+	"unicode/utf8"
+	"unsafe"
 )
 
 type Lexer struct {
 	*CharReader
-	Tokens        []*Token
-	runeTmpBuffer []rune
-	runeStk       *Stk[rune]
-	stateStk      *Stk[StateFn]
-	currentState  StateFn
-	tokenChan     chan *Token
-	pointer       int
-	line          uint
-	column        uint
-}
-
-func NewLexer(r io.ReadSeeker) *Lexer {
-	return &Lexer{
-		CharReader:    newCharReader(r),
-		Tokens:        make([]*Token, 0),
-		currentState:  lexToken,
-		runeTmpBuffer: make([]rune, 0),
-		tokenChan:     make(chan *Token, 3),
-		runeStk:       NewStk[rune](),
-		stateStk:      NewStk[StateFn](),
-		pointer:       0,
-		line:          0,
-		column:        0,
+	// Name of the source, only used to report errors
+	Filename string
+	// When Recover is set, lexical errors don't stop the lexer: the offending text is emitted
+	// as an Invalid token and the error is collected in Errors
+	Recover bool
+	Errors  ErrorList
+	// When CommentsAsTrivia is set, comments are attached to the tokens around them as trivia
+	// instead of being emitted as Comment tokens
+	CommentsAsTrivia bool
+	// Brackets selects whether "[" starts a character class or an optional group
+	Brackets BracketMode
+	// Columns is the unit columns of positions are counted in, runes by default
+	Columns ColumnUnit
+	// Normalize is applied to the names of non-terminals and actions, e.g. norm.NFC.String from
+	// golang.org/x/text, so names typed with different Unicode forms are the same. nil keeps them as is
+	Normalize func(string) string
+	Tokens    []*Token
+	runeStk   *Stk[rune]
+	// Closing runes of the calls and lists open inside an action
+	actionStk    *Stk[rune]
+	stateStk     *Stk[StateFn]
+	currentState StateFn
+	// Tokens handed over by NextToken, ended is set once the EndMark was queued
+	queue   []*Token
+	ended   bool
+	pointer int
+	// Position of the next character to be read
+	pos Position
+	// Position where the token being lexed starts
+	start Position
+	// The text read is kept in the window of the reader and tracked with offsets:
+	// lexemeStart is where the lexeme being read starts, rawStart where the current token
+	// starts with its delimiters, triviaStart where the text not emitted yet starts,
+	// and lineStart where the current line starts, used to report errors
+	lexemeStart int
+	rawStart    int
+	triviaStart int
+	lineStart   int
+	// Offset of the first newline outside a comment in the pending trivia, -1 if there's none yet
+	triviaBreak int
+	// Last token emitted
+	prev *Token
+	// Syntax of the grammar being lexed
+	dialect *Dialect
+	// When discard is set, tokens are dropped from Tokens once they're returned, see Stream
+	discard bool
+	// Slab the tokens are allocated from, see newToken
+	arena []Token
+	// opStart tells which bytes may start an operator of the dialect
+	opStart [256]bool
+	// File of a FileSet the source belongs to, nil if there's none
+	file *File
+}
+
+// NewLexer returns a lexer reading from r, which is read as needed and kept in memory only as
+// long as the lexer needs it
+func NewLexer(r io.Reader) *Lexer {
+	return newLexer(newCharReader(r))
+}
+
+// NewStringLexer returns a lexer over src. Lexemes, raw text and trivia are substrings of src,
+// so no text is copied
+func NewStringLexer(src string) *Lexer {
+	l := newLexer(newStringReader(src))
+	// Grammars average a token every few bytes, reserving room upfront saves growing Tokens
+	// over and over on large inputs
+	l.Tokens = make([]*Token, 0, len(src)/8)
+
+	return l
+}
+
+// NewBytesLexer returns a lexer over src without copying it, like NewStringLexer.
+// The tokens share the memory of src, which must not be modified afterwards
+func NewBytesLexer(src []byte) *Lexer {
+	return NewStringLexer(unsafe.String(unsafe.SliceData(src), len(src)))
+}
+
+func newLexer(r *CharReader) *Lexer {
+	l := &Lexer{
+		CharReader:   r,
+		Tokens:       make([]*Token, 0),
+		currentState: lexToken,
+		queue:        make([]*Token, 0, 2),
+		runeStk:      NewStk[rune](),
+		actionStk:    NewStk[rune](),
+		stateStk:     NewStk[StateFn](),
+		pointer:      0,
+		triviaBreak:  -1,
+		pos:          Position{Offset: 0, Line: 1, Column: 1},
+		start:        Position{Offset: 0, Line: 1, Column: 1},
 	}
+	l.setDialect(Default)
+
+	return l
 }
 
 func (l *Lexer) NextToken() (*Token, error) {
 	var err error
 	var state StateFn
 	for {
-		select {
-		case token, ok := <-l.tokenChan:
-			if !ok && token == nil {
-				return nil, nil
-			}
+		switch {
+		case len(l.queue) > 0:
+			token := l.queue[0]
+			l.queue = l.queue[:copy(l.queue, l.queue[1:])]
 			return token, nil
+		case l.ended:
+			return nil, nil
 		default:
+			current := l.currentState
 			if !l.stateStk.Empty() {
-				state, err = l.stateStk.Dequeue()(l)
-			} else {
-				state, err = l.currentState(l)
+				current = l.stateStk.Dequeue()
+			}
+			state, err = current(l)
+			if err == io.EOF {
+				// The input ended between tokens
+				state, err = nil, nil
 			}
 			if err != nil {
-				if err == io.EOF {
-					return nil, nil
+				err = l.locateError(err, current)
+				var lerr *Error
+				if !l.Recover || !errors.As(err, &lerr) {
+					return nil, err
 				}
-				return nil, err
+				l.Errors = append(l.Errors, lerr)
+				state = lexInvalid
 			}
 			if l.pointer < len(l.Tokens) {
-				l.tokenChan <- l.Tokens[l.pointer]
+				l.queue = append(l.queue, l.Tokens[l.pointer])
 				l.pointer++
+				if l.discard {
+					l.dropTokens()
+				}
 			}
 			l.clearRuneTmpBuffer()
 			l.currentState = state
 			if l.currentState == nil && l.stateStk.Empty() {
-				l.tokenChan <- NewToken("", l.line, l.column, EndMark)
-				close(l.tokenChan)
+				l.queue = append(l.queue, l.endMark())
+				l.ended = true
 			}
 		}
 	}
 }
 
+// dropTokens forgets the tokens that were already returned
+func (l *Lexer) dropTokens() {
+	n := copy(l.Tokens, l.Tokens[l.pointer:])
+	clear(l.Tokens[n:])
+	l.Tokens = l.Tokens[:n]
+	l.pointer = 0
+}
+
+// locateError attaches the position and the state to errors raised by the lexer.
+// Other errors, e.g. the ones returned by the underlying reader, are returned as they are
+func (l *Lexer) locateError(err error, state StateFn) error {
+	var lerr *Error
+	if !errors.As(err, &lerr) {
+		var cerr ErrCharReader
+		if !errors.As(err, &cerr) {
+			return err
+		}
+		r, perr := l.peekChar()
+		if perr != nil {
+			r = EOF
+		}
+		lerr = l.newError(err, r)
+	}
+	if lerr.State == "" {
+		lerr.State = stateName(state)
+	}
+
+	return lerr
+}
+
+// Err returns the errors collected while lexing in recovery mode, or nil if there were none
+func (l *Lexer) Err() error {
+	if len(l.Errors) == 0 {
+		return nil
+	}
+
+	return l.Errors
+}
+
 func (l *Lexer) PeekToken() (*Token, error) {
 	mark := l.Mark()
+	defer l.Release(mark)
 	defer l.Reset(mark)
 
 	return l.NextToken()
 }
 
-func (l *Lexer) Mark() int {
-	return l.pointer
+// Checkpoint is a snapshot of the lexer, see Mark
+type Checkpoint struct {
+	offset      int
+	pos, start  Position
+	width       int
+	last        rune
+	state       StateFn
+	stateStk    []StateFn
+	runeStk     []rune
+	actionStk   []rune
+	tokens      int
+	pointer     int
+	queue       []*Token
+	ended       bool
+	prev        *Token
+	trailing    string
+	errors      int
+	lexemeStart int
+	rawStart    int
+	triviaStart int
+	lineStart   int
+	triviaBreak int
+}
+
+// Mark takes a checkpoint of the whole lexer: the position in the input, the states and stacks
+// and the tokens emitted so far. Reset goes back to it and lexes the input again from there.
+// The input read after a checkpoint is kept in memory until the checkpoint is released.
+// Checkpoints can't be taken on a lexer that is being streamed
+func (l *Lexer) Mark() Checkpoint {
+	l.hold(l.offset())
+
+	cp := Checkpoint{
+		offset:      l.offset(),
+		pos:         l.pos,
+		start:       l.start,
+		width:       l.width,
+		last:        l.buffer[0],
+		state:       l.currentState,
+		stateStk:    clone(l.stateStk.stk),
+		runeStk:     clone(l.runeStk.stk),
+		actionStk:   clone(l.actionStk.stk),
+		tokens:      len(l.Tokens),
+		pointer:     l.pointer,
+		queue:       clone(l.queue),
+		ended:       l.ended,
+		prev:        l.prev,
+		errors:      len(l.Errors),
+		lexemeStart: l.lexemeStart,
+		rawStart:    l.rawStart,
+		triviaStart: l.triviaStart,
+		lineStart:   l.lineStart,
+		triviaBreak: l.triviaBreak,
+	}
+	if l.prev != nil {
+		cp.trailing = l.prev.TrailingTrivia
+	}
+
+	return cp
+}
+
+// Reset restores a checkpoint taken with Mark. The checkpoint stays valid, so the lexer can go
+// back to it several times until it's released
+func (l *Lexer) Reset(cp Checkpoint) {
+	l.seek(cp.offset)
+	l.pos = cp.pos
+	l.start = cp.start
+	l.width = cp.width
+	l.buffer[0] = cp.last
+	l.currentState = cp.state
+	l.stateStk.stk = append(l.stateStk.stk[:0], cp.stateStk...)
+	l.runeStk.stk = append(l.runeStk.stk[:0], cp.runeStk...)
+	l.actionStk.stk = append(l.actionStk.stk[:0], cp.actionStk...)
+	clear(l.Tokens[cp.tokens:])
+	l.Tokens = l.Tokens[:cp.tokens]
+	l.pointer = cp.pointer
+	l.queue = append(l.queue[:0], cp.queue...)
+	l.ended = cp.ended
+	l.prev = cp.prev
+	if l.prev != nil {
+		l.prev.TrailingTrivia = cp.trailing
+	}
+	l.Errors = l.Errors[:cp.errors]
+	l.lexemeStart = cp.lexemeStart
+	l.rawStart = cp.rawStart
+	l.triviaStart = cp.triviaStart
+	l.lineStart = cp.lineStart
+	l.triviaBreak = cp.triviaBreak
+	l.updatePin()
+}
+
+// Release tells the lexer a checkpoint won't be used anymore, so the input it holds can be dropped
+func (l *Lexer) Release(cp Checkpoint) {
+	l.release(cp.offset)
 }
 
-func (l *Lexer) Reset(mark int) {
-	l.pointer = mark
+func clone[T any](s []T) []T {
+	return append([]T(nil), s...)
 }
 
+// nextChar consumes the next rune and moves the position past it.
+// ASCII is read straight from the window, anything else goes through the UTF-8 decoder
 func (l *Lexer) nextChar() (rune, error) {
-	defer func(l *Lexer) {
-		if l.buffer[0] == '\n' {
-			l.line++
-			l.column = 0
-		} else {
-			l.column++
+	var r rune
+	columns := uint(1)
+	if l.off < len(l.buf) && l.buf[l.off] < utf8.RuneSelf {
+		r = rune(l.buf[l.off])
+		l.off++
+		l.width = 1
+	} else {
+		var err error
+		if r, l.width, err = l.ReadRune(); err != nil {
+			return 0, err
 		}
-		l.runeTmpBuffer = append(l.runeTmpBuffer, l.buffer[0])
-	}(l)
+		columns = l.Columns.width(r, l.width)
+		if r == bom && l.pos.Offset == 0 {
+			columns = 0
+		}
+		if l.file != nil && columns != uint(l.width) {
+			l.file.addRune(l.pos.Offset, l.width, int(columns))
+		}
+	}
+	l.buffer[0] = r
+
+	l.pos.Offset += l.width
+	if r == '\n' || r == '\r' && !l.crlf() {
+		l.pos.Line++
+		l.pos.Column = 1
+		l.lineStart = l.pos.Offset
+		l.updatePin()
+		if l.file != nil {
+			l.file.AddLine(l.pos.Offset)
+		}
+	} else {
+		l.pos.Column += columns
+	}
 
-	return l.CharReader.nextChar()
+	return r, nil
+}
+
+// crlf reports whether the "\r" just read is followed by "\n", the line then breaks after the "\n"
+func (l *Lexer) crlf() bool {
+	next, _ := l.Peek(1)
+
+	return len(next) == 1 && next[0] == '\n'
 }
 
 func (l *Lexer) peekChar() (rune, error) {
+	if l.off < len(l.buf) && l.buf[l.off] < utf8.RuneSelf {
+		return rune(l.buf[l.off]), nil
+	}
+
 	return l.CharReader.peekChar()
 }
 
-func (l *Lexer) emitTokenOpts(lexeme string, line, column uint, typ TokenType) {
-	token := NewToken(lexeme, line, column, typ)
+func (l *Lexer) emitTokenOpts(lexeme string, start, end Position, typ TokenType) {
+	l.emit(l.newToken(lexeme, start, end, typ), l.text(l.triviaStart, l.pos.Offset))
+}
+
+// emit appends a token to Tokens. text is everything read since the previous token, the raw
+// text and the trivia of the token are cut out of it, so a source that isn't in memory costs
+// a single copy per token
+func (l *Lexer) emit(token *Token, text string) {
+	token.Raw = text[l.rawStart-l.triviaStart:]
+	l.attachTrivia(token, text)
+	l.rawStart = l.pos.Offset
+	l.triviaStart = l.pos.Offset
+	l.updatePin()
 	l.Tokens = append(l.Tokens, token)
+	l.prev = token
+}
+
+// arenaSize is the number of tokens allocated at once by newToken
+const arenaSize = 256
+
+// newToken is NewToken with tokens carved out of a slab instead of allocated one by one
+func (l *Lexer) newToken(lexeme string, start, end Position, typ TokenType) *Token {
+	if len(l.arena) == cap(l.arena) {
+		l.arena = make([]Token, 0, arenaSize)
+	}
+	l.arena = l.arena[:len(l.arena)+1]
+
+	if l.Normalize != nil && isIdentifier(typ) {
+		lexeme = l.Normalize(lexeme)
+	}
+
+	token := &l.arena[len(l.arena)-1]
+	token.Lexeme = lexeme
+	token.Start = l.global(start)
+	token.End = l.global(end)
+	token.Type = typ
+
+	return token
+}
+
+// global fills in the Pos of p when the source is a file of a FileSet
+func (l *Lexer) global(p Position) Position {
+	if l.file != nil {
+		p.Pos = Pos(l.file.base + p.Offset)
+	}
+
+	return p
+}
+
+// endMark builds the EndMark token, which takes whatever trivia is left at the end of the input
+func (l *Lexer) endMark() *Token {
+	l.markStart()
+	token := l.newToken("", l.pos, l.pos, EndMark)
+	l.attachTrivia(token, l.text(l.triviaStart, l.rawStart))
+
+	return token
+}
+
+// attachTrivia splits the pending trivia between the previous token and token.
+// The previous token gets everything up to the end of its line, token gets the rest.
+// text is the input from the start of the pending trivia
+func (l *Lexer) attachTrivia(token *Token, text string) {
+	split := l.triviaStart
+	if l.prev != nil {
+		split = l.rawStart
+		if l.triviaBreak >= 0 {
+			split = l.triviaBreak
+		}
+		l.prev.TrailingTrivia = text[:split-l.triviaStart]
+	}
+	token.LeadingTrivia = text[split-l.triviaStart : l.rawStart-l.triviaStart]
+
+	l.triviaBreak = -1
+}
+
+// addTrivia turns the text read since the start of the current token into pending trivia
+func (l *Lexer) addTrivia(comment bool) {
+	if l.triviaBreak < 0 && !comment {
+		if i := bytes.IndexAny(l.window(l.rawStart, l.pos.Offset), "\r\n"); i >= 0 {
+			l.triviaBreak = l.rawStart + i
+		}
+	}
+	l.rawStart = l.pos.Offset
+}
+
+// lexeme returns the text read since the last call to clearRuneTmpBuffer
+func (l *Lexer) lexeme() string {
+	return l.text(l.lexemeStart, l.pos.Offset)
+}
+
+// updatePin tells the reader which part of its window the lexer still needs
+func (l *Lexer) updatePin() {
+	l.pin = min(l.lexemeStart, l.triviaStart, l.lineStart)
 }
 
 func (l *Lexer) emitToken(typ TokenType) {
-	l.emitTokenOpts(string(l.runeTmpBuffer), l.line, l.column, typ)
+	if l.lexemeStart < l.triviaStart {
+		l.emitTokenOpts(l.lexeme(), l.start, l.pos, typ)
+		return
+	}
+
+	l.emitSpan(l.lexemeStart, l.pos.Offset, typ)
+}
+
+// emitSpan emits a token whose lexeme is the input between two offsets of the current token
+func (l *Lexer) emitSpan(from, to int, typ TokenType) {
+	text := l.text(l.triviaStart, l.pos.Offset)
+	lexeme := text[from-l.triviaStart : to-l.triviaStart]
+	l.emit(l.newToken(lexeme, l.start, l.pos, typ), text)
+}
+
+// markStart records the current position as the start of the next token.
+// Whatever was read since the previous start and wasn't emitted becomes trivia
+func (l *Lexer) markStart() {
+	l.start = l.pos
+	l.addTrivia(false)
 }
 
 func (l *Lexer) clearRuneTmpBuffer() {
-	l.runeTmpBuffer = l.runeTmpBuffer[:0]
+	l.lexemeStart = l.pos.Offset
+	l.updatePin()
 }
 
 type Stk[T any] struct {
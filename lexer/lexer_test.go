@@ -2,10 +2,17 @@ package lexer
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"unsafe"
 )
 
 // Tests the lexer's ability to read a sequence of characters correctly
@@ -630,3 +637,1342 @@ func TestLexer_NextToken_GroupsAndNot(t *testing.T) {
 		t.Logf("Token: %s", token)
 	}
 }
+
+// Testing if tokens record where they start and end, delimiters included
+func TestLexer_NextToken_Positions(t *testing.T) {
+	buffer := []byte("<expr> ::= \"+\"\n  | NAME")
+	lexer := NewLexer(bytes.NewReader(buffer))
+
+	expected := []struct {
+		text      string
+		line, col uint
+		endLine   uint
+		endCol    uint
+	}{
+		{"<expr>", 1, 1, 1, 7},
+		{"::=", 1, 8, 1, 11},
+		{"\"+\"", 1, 12, 1, 15},
+		{"|", 2, 3, 2, 4},
+		{"NAME", 2, 5, 2, 9},
+	}
+
+	for _, e := range expected {
+		token, err := lexer.NextToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if text := string(buffer[token.Start.Offset:token.End.Offset]); text != e.text {
+			t.Fatalf("Expected %s, got %s", e.text, text)
+		}
+		if token.Start.Line != e.line || token.Start.Column != e.col {
+			t.Fatalf("Expected start %d:%d, got %s", e.line, e.col, token.Start)
+		}
+		if token.End.Line != e.endLine || token.End.Column != e.endCol {
+			t.Fatalf("Expected end %d:%d, got %s", e.endLine, e.endCol, token.End)
+		}
+	}
+}
+
+// Testing if lexical errors carry the position, the offending rune and the state
+func TestLexer_NextToken_Error(t *testing.T) {
+	buffer := []byte("<expr> ::= <term>\n\t<a> :: b")
+	lexer := NewLexer(bytes.NewReader(buffer))
+	lexer.Filename = "test.bnf"
+
+	_, err := lexAll(lexer)
+
+	if !errors.Is(err, ErrUnexpectedRune) {
+		t.Fatalf("Expected ErrUnexpectedRune, got %v", err)
+	}
+
+	var lerr *Error
+	if !errors.As(err, &lerr) {
+		t.Fatalf("Expected *Error, got %T", err)
+	}
+	if lerr.Pos.Line != 2 || lerr.Pos.Column != 8 {
+		t.Fatalf("Expected 2:8, got %s", lerr.Pos)
+	}
+	if lerr.Rune != ' ' {
+		t.Fatalf("Expected ' ', got %q", lerr.Rune)
+	}
+	if len(lerr.Expected) != 1 || lerr.Expected[0] != '=' {
+		t.Fatalf("Expected ['='], got %q", lerr.Expected)
+	}
+	if lerr.State != "lexAssignment" {
+		t.Fatalf("Expected lexAssignment, got %s", lerr.State)
+	}
+
+	expected := "test.bnf:2:8: unexpected rune ' ' in lexAssignment, expected '='"
+	if err.Error() != expected {
+		t.Fatalf("Expected %s, got %s", expected, err)
+	}
+
+	snippet := "\t<a> :: b\n\t      ^"
+	if lerr.Snippet() != snippet {
+		t.Fatalf("Expected %q, got %q", snippet, lerr.Snippet())
+	}
+}
+
+// Testing if an unterminated string is reported instead of being silently dropped
+func TestLexer_NextToken_UnterminatedString(t *testing.T) {
+	buffer := []byte("<expr> ::= \"abc")
+	lexer := NewLexer(bytes.NewReader(buffer))
+
+	_, err := lexAll(lexer)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	if !errors.Is(err, ErrUnexpectedEOF) {
+		t.Fatalf("Expected ErrUnexpectedEOF, got %v", err)
+	}
+	t.Logf("Error: %s", err)
+}
+
+// Testing if the lexer keeps going after errors in recovery mode
+func TestLexer_NextToken_Recover(t *testing.T) {
+	buffer := []byte("<a> :: x\n<b> ::= \"ok\" )\n<c> :=  y")
+	lexer := NewLexer(bytes.NewReader(buffer))
+	lexer.Recover = true
+
+	invalid := make([]string, 0)
+	token, err := lexer.NextToken()
+	for token != nil {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Type == Invalid {
+			invalid = append(invalid, token.Lexeme)
+		}
+		token, err = lexer.NextToken()
+	}
+
+	if len(invalid) != 3 || invalid[0] != "::" || invalid[1] != ")" || invalid[2] != ":=" {
+		t.Fatalf("Expected [:: ) :=], got %q", invalid)
+	}
+
+	if len(lexer.Errors) != 3 {
+		t.Fatalf("Expected 3 errors, got %d", len(lexer.Errors))
+	}
+	if lexer.Errors[1].Pos.Line != 2 || lexer.Errors[2].Pos.Line != 3 {
+		t.Fatalf("Expected errors on lines 2 and 3, got %s and %s", lexer.Errors[1].Pos, lexer.Errors[2].Pos)
+	}
+	if !errors.Is(lexer.Err(), ErrUnexpectedRune) {
+		t.Fatalf("Expected ErrUnexpectedRune, got %v", lexer.Err())
+	}
+
+	// The tokens after the errors must still be there
+	last := lexer.Tokens[len(lexer.Tokens)-1]
+	if last.Lexeme != "y" {
+		t.Fatalf("Expected y, got %s", last.Lexeme)
+	}
+
+	t.Logf("Errors: %s", lexer.Err())
+}
+
+// Testing if a string left open is reported at its opening quote and the next lines are still lexed
+func TestLexer_NextToken_RecoverUnterminatedString(t *testing.T) {
+	lexer := NewStringLexerWithOptions("<a> ::= \"abc\n<b> ::= \"ok\"\n<c> ::= <x> 'y z\r\n<d> ::= w", Options{Recover: true})
+
+	tokens, err := lexAll(lexer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"a", "::=", `"abc`, "b", "::=", "ok", "c", "::=", "x", "'y z", "d", "::=", "w", ""}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %d tokens, got %d: %s", len(expected), len(tokens), tokens)
+	}
+	for i, token := range tokens {
+		if token.Lexeme != expected[i] {
+			t.Fatalf("Expected %q, got %q", expected[i], token.Lexeme)
+		}
+	}
+	if tokens[2].Type != Invalid || tokens[9].Type != Invalid {
+		t.Fatalf("Expected the open strings to be Invalid, got %s and %s", tokens[2].Type, tokens[9].Type)
+	}
+
+	if len(lexer.Errors) != 2 {
+		t.Fatalf("Expected 2 errors, got %d", len(lexer.Errors))
+	}
+	for i, pos := range []string{"1:9", "3:13"} {
+		err := lexer.Errors[i]
+		if !errors.Is(err, ErrUnterminatedString) || err.Pos.String() != pos {
+			t.Fatalf("Expected %v at %s, got %v", ErrUnterminatedString, pos, err)
+		}
+	}
+}
+
+// Testing if the lexer emits line and block comments as Comment tokens
+func TestLexer_NextToken_Comments(t *testing.T) {
+	buffer := []byte("# hash\n<a> ::= x ; semicolon\n// slashes\n(* block\n comment *) <b> ::= (y) // end")
+	lexer := NewLexer(bytes.NewReader(buffer))
+
+	expected := []struct {
+		lexeme string
+		typ    TokenType
+	}{
+		{"# hash", Comment},
+		{"a", NonTerminalSymbol},
+		{"::=", ProdRule},
+		{"x", TerminalSymbol},
+		{"; semicolon", Comment},
+		{"// slashes", Comment},
+		{"(* block\n comment *)", Comment},
+		{"b", NonTerminalSymbol},
+		{"::=", ProdRule},
+		{"(", ParenLeft},
+		{"y", TerminalSymbol},
+		{")", ParenRight},
+		{"// end", Comment},
+	}
+
+	for _, e := range expected {
+		token, err := lexer.NextToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Lexeme != e.lexeme || token.Type != e.typ {
+			t.Fatalf("Expected %q (%s), got %q (%s)", e.lexeme, e.typ, token.Lexeme, token.Type)
+		}
+	}
+}
+
+// Testing if an unterminated block comment is reported
+func TestLexer_NextToken_UnterminatedComment(t *testing.T) {
+	buffer := []byte("<a> ::= x (* never closed")
+	lexer := NewLexer(bytes.NewReader(buffer))
+
+	_, err := lexAll(lexer)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	if !errors.Is(err, ErrUnexpectedEOF) {
+		t.Fatalf("Expected ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+// Testing if escape sequences are decoded while the raw text is kept
+func TestLexer_NextToken_Escapes(t *testing.T) {
+	buffer := []byte(`"a\"b" 'it\'s' "\\\n\t\r" "\x41é\u{1F600}"`)
+	lexer := NewLexer(bytes.NewReader(buffer))
+
+	expected := []struct {
+		lexeme string
+		raw    string
+	}{
+		{`a"b`, `"a\"b"`},
+		{`it's`, `'it\'s'`},
+		{"\\\n\t\r", `"\\\n\t\r"`},
+		{"Aé😀", `"\x41é\u{1F600}"`},
+	}
+
+	for _, e := range expected {
+		token, err := lexer.NextToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Lexeme != e.lexeme {
+			t.Fatalf("Expected %q, got %q", e.lexeme, token.Lexeme)
+		}
+		if token.Raw != e.raw {
+			t.Fatalf("Expected raw %q, got %q", e.raw, token.Raw)
+		}
+	}
+}
+
+// Testing if malformed escape sequences are reported at the backslash
+func TestLexer_NextToken_InvalidEscapes(t *testing.T) {
+	inputs := []string{`"\q"`, `"\x4"`, `"\uZZZZ"`, `"\u{}"`, `"\u{110000}"`, `"\u{41"`, `"\uD800"`}
+
+	for _, input := range inputs {
+		lexer := NewLexer(bytes.NewReader([]byte("<a> ::= " + input)))
+
+		_, err := lexAll(lexer)
+		if err == nil {
+			t.Fatalf("Expected an error for %s", input)
+		}
+
+		var lerr *Error
+		if !errors.As(err, &lerr) {
+			t.Fatalf("Expected *Error for %s, got %v", input, err)
+		}
+		if !errors.Is(err, ErrInvalidEscape) && !errors.Is(err, ErrUnexpectedRune) {
+			t.Fatalf("Expected ErrInvalidEscape for %s, got %v", input, err)
+		}
+		if lerr.Pos.Column != 10 {
+			t.Fatalf("Expected column 10 for %s, got %d", input, lerr.Pos.Column)
+		}
+	}
+}
+
+// Testing if character classes are told apart from optional groups and parsed
+func TestLexer_NextToken_CharClass(t *testing.T) {
+	buffer := []byte(`![a-Z] [^"\n] [\p{L}_\-0-9] [<term>] [x]`)
+	lexer := NewLexer(bytes.NewReader(buffer))
+
+	for lexer.Tokens == nil || len(lexer.Tokens) < 9 {
+		token, err := lexer.NextToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token == nil {
+			break
+		}
+	}
+
+	types := []TokenType{Not, CharClass, CharClass, CharClass, BracketLeft, NonTerminalSymbol, BracketRight, BracketLeft, TerminalSymbol}
+	for i, typ := range types {
+		if lexer.Tokens[i].Type != typ {
+			t.Fatalf("Expected %s at %d, got %s", typ, i, lexer.Tokens[i])
+		}
+	}
+
+	set := lexer.Tokens[1].Set
+	if !set.Contains('a') || !set.Contains('Z') || !set.Contains('_') || set.Contains('b') {
+		t.Fatalf("Unexpected content of %s", set)
+	}
+
+	set = lexer.Tokens[2].Set
+	if !set.Negated || set.Contains('"') || set.Contains('\n') || !set.Contains('a') {
+		t.Fatalf("Unexpected content of %s", set)
+	}
+
+	set = lexer.Tokens[3].Set
+	if !set.Contains('é') || !set.Contains('-') || !set.Contains('5') || set.Contains(' ') {
+		t.Fatalf("Unexpected content of %s", set)
+	}
+	if set.String() != `[_\-0-9\p{L}]` {
+		t.Fatalf("Expected [_\\-0-9\\p{L}], got %s", set)
+	}
+}
+
+// Testing if the bracket mode overrides the heuristic
+func TestLexer_NextToken_BracketMode(t *testing.T) {
+	lexer := NewLexer(bytes.NewReader([]byte("[x]")))
+	lexer.Brackets = BracketCharClass
+
+	token, err := lexer.NextToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Type != CharClass || !token.Set.Contains('x') {
+		t.Fatalf("Expected a class containing x, got %s", token)
+	}
+
+	lexer = NewLexer(bytes.NewReader([]byte("[a-z]")))
+	lexer.Brackets = BracketOptional
+
+	token, err = lexer.NextToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Type != BracketLeft {
+		t.Fatalf("Expected BracketLeft, got %s", token)
+	}
+}
+
+// Testing if malformed character classes are reported
+func TestLexer_NextToken_InvalidCharClass(t *testing.T) {
+	inputs := []string{`[^]`, `[\p{Nope}]`, `[^a`, "[^a\n]"}
+
+	for _, input := range inputs {
+		lexer := NewLexer(bytes.NewReader([]byte(input)))
+
+		_, err := lexer.NextToken()
+		var lerr *Error
+		if !errors.As(err, &lerr) {
+			t.Fatalf("Expected *Error for %s, got %v", input, err)
+		}
+	}
+}
+
+// Testing if postfix operators are told apart from terminals and actions
+func TestLexer_NextToken_Repetition(t *testing.T) {
+	buffer := []byte(`<a>* "*" <b>+ c? (<d>){2,5} [a-z]{,3} x + y <e>{ Fn(e) }`)
+	lexer := NewLexer(bytes.NewReader(buffer))
+
+	expected := []struct {
+		lexeme string
+		typ    TokenType
+	}{
+		{"a", NonTerminalSymbol},
+		{"*", ZeroOrMore},
+		{"*", TerminalSymbol},
+		{"b", NonTerminalSymbol},
+		{"+", OneOrMore},
+		{"c", TerminalSymbol},
+		{"?", ZeroOrOne},
+		{"(", ParenLeft},
+		{"d", NonTerminalSymbol},
+		{")", ParenRight},
+		{"{2,5}", Repeat},
+		{"[a-z]", CharClass},
+		{"{,3}", Repeat},
+		{"x", TerminalSymbol},
+		{"+", TerminalSymbol},
+		{"y", TerminalSymbol},
+		{"e", NonTerminalSymbol},
+		{"Fn", Action},
+	}
+
+	for _, e := range expected {
+		token, err := lexer.NextToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Lexeme != e.lexeme || token.Type != e.typ {
+			t.Fatalf("Expected %q (%s), got %q (%s)", e.lexeme, e.typ, token.Lexeme, token.Type)
+		}
+		if token.Type == Repeat {
+			if min, max, err := RepeatBounds(token); err != nil {
+				t.Fatal(err)
+			} else if token.Lexeme == "{2,5}" && (min != 2 || max != 5) {
+				t.Fatalf("Expected 2,5, got %d,%d", min, max)
+			} else if token.Lexeme == "{,3}" && (min != 0 || max != 3) {
+				t.Fatalf("Expected 0,3, got %d,%d", min, max)
+			}
+		}
+	}
+}
+
+// Testing if bounds that don't make sense are reported at the offending character
+func TestLexer_NextToken_InvalidRepetition(t *testing.T) {
+	tests := []struct {
+		source string
+		offset int
+		r      rune
+	}{
+		{"<a>{5,2}", 7, '}'},
+		{"<a>{1 2}", 6, '2'},
+		{"<a>{,}", 5, '}'},
+		{"<a>{1,2,3}", 7, ','},
+		{"<a>{99999999}", 10, '9'},
+	}
+
+	for _, test := range tests {
+		lexer := NewStringLexer(test.source)
+
+		_, err := lexAll(lexer)
+		if err == nil {
+			t.Fatalf("Expected an error for %s", test.source)
+		}
+
+		var lerr *Error
+		if !errors.As(err, &lerr) || !errors.Is(err, ErrInvalidRepetition) {
+			t.Fatalf("Expected ErrInvalidRepetition for %s, got %v", test.source, err)
+		}
+		if lerr.Pos.Offset != test.offset || lerr.Rune != test.r {
+			t.Fatalf("Expected %q at %d for %s, got %q at %d", test.r, test.offset, test.source, lerr.Rune, lerr.Pos.Offset)
+		}
+	}
+}
+
+// Testing if spaces around the bounds are allowed and the bounds are read like the lexer reads them
+func TestRepeatBounds(t *testing.T) {
+	tokens, err := lexAll(NewStringLexer("<a>{ 3 } <b>{ 1 , }"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens[1].Type != Repeat || tokens[3].Type != Repeat {
+		t.Fatalf("Expected Repeat tokens, got %s and %s", tokens[1], tokens[3])
+	}
+	if min, max, err := RepeatBounds(tokens[1]); err != nil || min != 3 || max != 3 {
+		t.Fatalf("Expected 3,3, got %d,%d, %v", min, max, err)
+	}
+	if min, max, err := RepeatBounds(tokens[3]); err != nil || min != 1 || max != -1 {
+		t.Fatalf("Expected 1,-1, got %d,%d, %v", min, max, err)
+	}
+
+	for _, lexeme := range []string{"{1 2}", "{,}", "3", "{3"} {
+		if _, _, err := RepeatBounds(&Token{Lexeme: lexeme, Type: Repeat}); !errors.Is(err, ErrInvalidRepetition) {
+			t.Fatalf("Expected ErrInvalidRepetition for %s, got %v", lexeme, err)
+		}
+	}
+}
+
+// Testing if the dialects switch operators, non-terminal syntax and comments
+func TestLexer_NextToken_Dialects(t *testing.T) {
+	tests := []struct {
+		dialect *Dialect
+		input   string
+		types   []TokenType
+	}{
+		{GBNF, "root ::= ws-name [a-z]+ # comment\n", []TokenType{NonTerminalSymbol, ProdRule, NonTerminalSymbol, CharClass, OneOrMore, Comment}},
+		{PEG, "Expr <- Term \"+\" Expr / Term", []TokenType{NonTerminalSymbol, ProdRule, NonTerminalSymbol, TerminalSymbol, NonTerminalSymbol, Or, NonTerminalSymbol}},
+		{EBNF, "expr = term, \"+\", expr ; (* c *)", []TokenType{NonTerminalSymbol, ProdRule, NonTerminalSymbol, TerminalSymbol, NonTerminalSymbol, EndOfRule, Comment}},
+		{EBNF, "expr : term | \"x\" ; /* c */", []TokenType{NonTerminalSymbol, ProdRule, NonTerminalSymbol, Or, TerminalSymbol, EndOfRule, Comment}},
+		{EBNF, "expr = term, { \"+\", term } ;", []TokenType{NonTerminalSymbol, ProdRule, NonTerminalSymbol, BraceLeft, TerminalSymbol, NonTerminalSymbol, BraceRight, EndOfRule}},
+		{BNF, "<a> ::= [<b>] ; c", []TokenType{NonTerminalSymbol, ProdRule, BracketLeft, NonTerminalSymbol, BracketRight, Comment}},
+	}
+
+	for _, test := range tests {
+		lexer := NewLexerWithOptions(bytes.NewReader([]byte(test.input)), Options{Dialect: test.dialect})
+
+		for _, typ := range test.types {
+			token, err := lexer.NextToken()
+			if err != nil {
+				t.Fatalf("%s: %s", test.dialect.Name, err)
+			}
+			if token.Type != typ {
+				t.Fatalf("%s: expected %s, got %s", test.dialect.Name, typ, token)
+			}
+		}
+	}
+}
+
+// Testing if action arguments are split on commas with or without spaces, and nested calls are kept apart
+func TestLexer_NextToken_ActionArgs(t *testing.T) {
+	buffer := []byte(`{ Add(x,y) } { Add(x, Mul(y, z)) } { F("s,)", 12, [a]) }`)
+	lexer := NewLexer(bytes.NewReader(buffer))
+
+	expected := []struct {
+		lexeme string
+		typ    TokenType
+	}{
+		{"Add", Action}, {"x", ActionArg}, {"y", ActionArg}, {")", ActionCallEnd},
+		{"Add", Action}, {"x", ActionArg}, {"Mul", Action}, {"y", ActionArg}, {"z", ActionArg}, {")", ActionCallEnd}, {")", ActionCallEnd},
+		{"F", Action}, {"s,)", ActionString}, {"12", ActionNumber}, {"[", ActionList}, {"a", ActionArg}, {"]", ActionListEnd}, {")", ActionCallEnd},
+	}
+
+	for _, e := range expected {
+		token, err := lexer.NextToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Lexeme != e.lexeme || token.Type != e.typ {
+			t.Fatalf("Expected %q (%s), got %q (%s)", e.lexeme, e.typ, token.Lexeme, token.Type)
+		}
+	}
+
+	token, err := lexer.NextToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Type != EndMark {
+		t.Fatalf("Expected EndMark, got %s", token)
+	}
+}
+
+// Testing if malformed actions are reported
+func TestLexer_NextToken_InvalidAction(t *testing.T) {
+	inputs := []string{`{ Add(x y) }`, `{ Add(x, ] }`, `{ Add(x) `, `{ Add }`, `{ Add(x]) }`}
+
+	for _, input := range inputs {
+		lexer := NewLexer(bytes.NewReader([]byte(input)))
+
+		_, err := lexAll(lexer)
+		if err == nil {
+			t.Fatalf("Expected an error for %s", input)
+		}
+
+		var lerr *Error
+		if !errors.As(err, &lerr) {
+			t.Fatalf("Expected *Error for %s, got %v", input, err)
+		}
+	}
+}
+
+// Testing if code blocks keep balanced braces, and braces in strings and comments don't end them
+func TestLexer_NextToken_CodeBlock(t *testing.T) {
+	code := "if x > 0 { return Add(x, y), nil } // }}\n\t/* }} */ s := \"}}\\\"\" + `}}` + string('}')\n\treturn nil, nil"
+	buffer := []byte("<expr> ::= x=<term> {{ " + code + " }} <rest>")
+	lexer := NewLexer(bytes.NewReader(buffer))
+
+	var block *Token
+	for {
+		token, err := lexer.NextToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Type == EndMark {
+			break
+		}
+		if token.Type == CodeBlock {
+			block = token
+		}
+	}
+
+	if block == nil {
+		t.Fatal("Expected a CodeBlock token")
+	}
+	if block.Lexeme != code {
+		t.Fatalf("Expected %q, got %q", code, block.Lexeme)
+	}
+	if block.Raw != "{{ "+code+" }}" {
+		t.Fatalf("Expected the raw block, got %q", block.Raw)
+	}
+	if last := lexer.Tokens[len(lexer.Tokens)-1]; last.Lexeme != "rest" {
+		t.Fatalf("Expected rest after the block, got %s", last)
+	}
+}
+
+// Testing if unterminated code blocks are reported
+func TestLexer_NextToken_InvalidCodeBlock(t *testing.T) {
+	inputs := []string{`{{ return x`, `{{ if x {`, `{{ s := "}} }}`, `{{ /* }} }}`}
+
+	for _, input := range inputs {
+		lexer := NewLexer(bytes.NewReader([]byte(input)))
+
+		_, err := lexAll(lexer)
+		if err == nil {
+			t.Fatalf("Expected an error for %s", input)
+		}
+
+		if !errors.Is(err, ErrUnexpectedEOF) {
+			t.Fatalf("Expected ErrUnexpectedEOF for %s, got %v", input, err)
+		}
+	}
+}
+
+// Testing if a brace closing nothing in a code block is reported where it is
+func TestLexer_NextToken_UnbalancedCodeBlock(t *testing.T) {
+	inputs := []struct {
+		source string
+		offset int
+	}{
+		{"{{ a } b }}", 5},
+		{"{{ return x }", 12},
+		{"{{ if x { } } }", 12},
+		{"{{ if x { }}", 11},
+	}
+
+	for _, input := range inputs {
+		lexer := NewLexer(bytes.NewReader([]byte(input.source)))
+
+		_, err := lexer.NextToken()
+		var lerr *Error
+		if !errors.As(err, &lerr) || !errors.Is(err, ErrUnexpectedRune) || lerr.Rune != '}' {
+			t.Fatalf("Expected an unexpected } for %s, got %v", input.source, err)
+		}
+		if lerr.Pos.Offset != input.offset {
+			t.Fatalf("Expected the error at offset %d for %s, got %d", input.offset, input.source, lerr.Pos.Offset)
+		}
+	}
+}
+
+// Testing if the text of the tokens, trivia included, reproduces the input
+func TestLexer_NextToken_Trivia(t *testing.T) {
+	inputs := []struct {
+		source string
+		opts   Options
+	}{
+		{"  <expr> ::= <term>   \"+\" <expr>\t| <term> !!\n\n<term> ::= [a-z]+ x=<a>{2,3}\n", Options{}},
+		{"<expr> ::= x=<term> { Add( x ,Mul(y, \"s\", [1, -2.5]) ) }\n<b> ::= {{ return x }} ", Options{}},
+		{"# comment\n<a> ::= <b> // trailing\n(* block\n comment *) <c> ::= 'd'", Options{Dialect: EBNF}},
+		{"# comment\n<a> ::= <b> # trailing\n<c> ::= \"\\x41\\n\" ; last", Options{CommentsAsTrivia: true}},
+		{"expr ::= term (\"+\" term)* # sum\nterm ::= [0-9]+", Options{Dialect: GBNF, CommentsAsTrivia: true}},
+		{"<a> :: <b>\n<c> ::= ) <d> := <e>", Options{Recover: true}},
+	}
+
+	for _, input := range inputs {
+		lexer := NewLexerWithOptions(bytes.NewReader([]byte(input.source)), input.opts)
+
+		tokens := make([]*Token, 0)
+		for {
+			token, err := lexer.NextToken()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens = append(tokens, token)
+			if token.Type == EndMark {
+				break
+			}
+		}
+
+		var text strings.Builder
+		for _, token := range tokens {
+			text.WriteString(token.Text())
+		}
+		if text.String() != input.source {
+			t.Fatalf("Expected %q, got %q", input.source, text.String())
+		}
+	}
+}
+
+// Testing if trivia is split at the end of the line of the previous token
+func TestLexer_NextToken_TriviaSplit(t *testing.T) {
+	buffer := []byte("<a> ::= <b> # one\n  # two\n<c> ::= <d>")
+	lexer := NewLexerWithOptions(bytes.NewReader(buffer), Options{CommentsAsTrivia: true})
+
+	for i := 0; i < 4; i++ {
+		if _, err := lexer.NextToken(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, c := lexer.Tokens[2], lexer.Tokens[3]
+	if b.TrailingTrivia != " # one" {
+		t.Fatalf("Expected %q, got %q", " # one", b.TrailingTrivia)
+	}
+	if c.LeadingTrivia != "\n  # two\n" {
+		t.Fatalf("Expected %q, got %q", "\n  # two\n", c.LeadingTrivia)
+	}
+	for _, token := range lexer.Tokens {
+		if token.Type == Comment {
+			t.Fatalf("Expected no Comment tokens, got %s", token)
+		}
+	}
+}
+
+// Testing if the stream returns the same tokens as NextToken, trivia included
+func TestLexer_Stream(t *testing.T) {
+	buffer := []byte("<expr> ::= <term> \"+\" <expr> # sum\n\t| <term>\n<term> ::= [0-9]+ { Num(x, [1, 2]) } ")
+
+	expected := make([]*Token, 0)
+	lexer := NewLexer(bytes.NewReader(buffer))
+	for {
+		token, err := lexer.NextToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, token)
+		if token.Type == EndMark {
+			break
+		}
+	}
+
+	stream := NewLexer(bytes.NewReader(buffer)).Stream(context.Background(), 1)
+	defer stream.Close()
+
+	for _, e := range expected {
+		token, err := stream.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Lexeme != e.Lexeme || token.Type != e.Type || token.Start != e.Start || token.Text() != e.Text() {
+			t.Fatalf("Expected %s %q, got %s %q", e, e.Text(), token, token.Text())
+		}
+		if len(stream.window) > 1 {
+			t.Fatalf("Expected consumed tokens to be dropped, %d are retained", len(stream.window))
+		}
+	}
+
+	token, err := stream.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Type != EndMark {
+		t.Fatalf("Expected EndMark again, got %s", token)
+	}
+}
+
+// Testing if a mark retains the tokens read after it so the stream can go back to it
+func TestLexer_Stream_MarkReset(t *testing.T) {
+	buffer := []byte("<a> ::= <b> <c> <d> <e>")
+	stream := NewLexer(bytes.NewReader(buffer)).Stream(context.Background(), 2)
+	defer stream.Close()
+
+	if _, err := stream.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	mark := stream.Mark()
+	for i := 0; i < 3; i++ {
+		if _, err := stream.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stream.Reset(mark)
+	token, err := stream.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Type != ProdRule {
+		t.Fatalf("Expected ::= after reset, got %s", token)
+	}
+
+	peeked, err := stream.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = stream.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peeked != token || token.Lexeme != "b" {
+		t.Fatalf("Expected b twice, got %s and %s", peeked, token)
+	}
+
+	stream.Release(mark)
+	if len(stream.window) != 1 {
+		t.Fatalf("Expected only the unread tokens to be retained, got %d", len(stream.window))
+	}
+}
+
+// Testing if errors and cancellation end the stream
+func TestLexer_Stream_Errors(t *testing.T) {
+	stream := NewLexer(bytes.NewReader([]byte("<a> :: <b>"))).Stream(context.Background(), 4)
+	defer stream.Close()
+
+	if _, err := stream.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Next(); !errors.Is(err, ErrUnexpectedRune) {
+		t.Fatalf("Expected ErrUnexpectedRune, got %v", err)
+	}
+	if _, err := stream.Next(); !errors.Is(err, ErrUnexpectedRune) {
+		t.Fatalf("Expected the error again, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	buffer := bytes.Repeat([]byte("<a> ::= <b>\n"), 1000)
+	stream = NewLexer(bytes.NewReader(buffer)).Stream(ctx, 1)
+	defer stream.Close()
+
+	if _, err := stream.Next(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	var err error
+	for i := 0; err == nil; i++ {
+		if i > 10 {
+			t.Fatal("Expected the stream to stop after cancellation")
+		}
+		_, err = stream.Next()
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
+
+// lexAll returns the tokens returned by NextToken up to the EndMark or the first error
+func lexAll(lexer *Lexer) ([]*Token, error) {
+	tokens := make([]*Token, 0)
+	for {
+		token, err := lexer.NextToken()
+		if err != nil {
+			return tokens, err
+		}
+		if token == nil {
+			return tokens, errors.New("no EndMark before the end of the tokens")
+		}
+		tokens = append(tokens, token)
+		if token.Type == EndMark {
+			return tokens, nil
+		}
+	}
+}
+
+// describe returns the type, span and text of the tokens, one per line
+func describe(tokens []*Token) string {
+	lines := make([]string, len(tokens))
+	for i, token := range tokens {
+		lines[i] = fmt.Sprintf("%s %s-%s %q", token, token.Start, token.End, token.Text())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Testing if resetting to a checkpoint taken in the middle of an action lexes the same tokens again
+func TestLexer_MarkReset_State(t *testing.T) {
+	buffer := []byte("<a> ::= x=<b> { Add(x, Mul(y, [1, 2])) } # c\n<d> ::= ) <e>")
+	lexer := NewLexerWithOptions(bytes.NewReader(buffer), Options{Recover: true})
+
+	for i := 0; i < 6; i++ {
+		if _, err := lexer.NextToken(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lexer.actionStk.Empty() {
+		t.Fatal("Expected the checkpoint to be taken inside the action")
+	}
+
+	mark := lexer.Mark()
+	expected, err := lexAll(lexer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lexer.Errors) != 1 {
+		t.Fatalf("Expected 1 error, got %d", len(lexer.Errors))
+	}
+
+	for i := 0; i < 2; i++ {
+		lexer.Reset(mark)
+		if len(lexer.Errors) != 0 {
+			t.Fatalf("Expected the errors to be reset, got %d", len(lexer.Errors))
+		}
+
+		tokens, err := lexAll(lexer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if describe(tokens) != describe(expected) {
+			t.Fatalf("Expected\n%s\ngot\n%s", describe(expected), describe(tokens))
+		}
+	}
+	lexer.Release(mark)
+}
+
+// Testing if peeking at the end of the input doesn't consume the EndMark
+func TestLexer_PeekToken_EndMark(t *testing.T) {
+	lexer := NewLexer(bytes.NewReader([]byte("<a> ")))
+
+	if _, err := lexer.NextToken(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		token, err := lexer.PeekToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token == nil || token.Type != EndMark {
+			t.Fatalf("Expected EndMark, got %v", token)
+		}
+	}
+
+	token, err := lexer.NextToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil || token.Type != EndMark {
+		t.Fatalf("Expected EndMark, got %v", token)
+	}
+	if lexer.Tokens[0].TrailingTrivia != " " {
+		t.Fatalf("Expected the trailing space to be kept, got %q", lexer.Tokens[0].TrailingTrivia)
+	}
+}
+
+// Testing if the reader keeps the input a checkpoint needs and drops it otherwise
+func TestLexer_MarkReset_Window(t *testing.T) {
+	buffer := bytes.Repeat([]byte("<rule> ::= <a> \"b\" [c-d]* | <e>\n"), 2000)
+
+	lexer := NewLexer(bytes.NewReader(buffer))
+	if _, err := lexAll(lexer); err != nil {
+		t.Fatal(err)
+	}
+	if cap(lexer.buf) > 4*minRead {
+		t.Fatalf("Expected the window to stay small, got %d bytes", cap(lexer.buf))
+	}
+
+	lexer = NewLexer(bytes.NewReader(buffer))
+	mark := lexer.Mark()
+	expected, err := lexAll(lexer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lexer.buf) < len(buffer) {
+		t.Fatalf("Expected the whole input to be kept, got %d bytes", len(lexer.buf))
+	}
+
+	lexer.Reset(mark)
+	tokens, err := lexAll(lexer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != len(expected) || describe(tokens[len(tokens)-2:]) != describe(expected[len(expected)-2:]) {
+		t.Fatalf("Expected\n%s\ngot\n%s", describe(expected[len(expected)-2:]), describe(tokens[len(tokens)-2:]))
+	}
+}
+
+// Testing if the lexer gives the same tokens for plain readers, strings and byte slices
+func TestLexer_Sources(t *testing.T) {
+	source := "<expr> ::= x=<term> \"\\x2B\" <expr> # sum\n\t| [a-zé]+ { Add(x, 1) } (* end *)"
+	opts := Options{Dialect: EBNF}
+
+	expected, err := lexAll(NewStringLexerWithOptions(source, opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lexers := map[string]*Lexer{
+		"one byte reader": NewLexerWithOptions(iotest.OneByteReader(strings.NewReader(source)), opts),
+		"half reader":     NewLexerWithOptions(iotest.HalfReader(strings.NewReader(source)), opts),
+		"bytes":           NewBytesLexerWithOptions([]byte(source), opts),
+	}
+
+	for name, lexer := range lexers {
+		tokens, err := lexAll(lexer)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if describe(tokens) != describe(expected) {
+			t.Fatalf("%s: expected\n%s\ngot\n%s", name, describe(expected), describe(tokens))
+		}
+	}
+}
+
+// Testing if the text of the tokens lexed from a string points into the string
+func TestLexer_Sources_ZeroCopy(t *testing.T) {
+	source := strings.Repeat("<rule> ::= <a> 'b' [c-d]* | <e> # f\n", 100)
+	lexer := NewStringLexerWithOptions(source, Options{CommentsAsTrivia: true})
+	if _, err := lexAll(lexer); err != nil {
+		t.Fatal(err)
+	}
+
+	start := uintptr(unsafe.Pointer(unsafe.StringData(source)))
+	inSource := func(s string) bool {
+		p := uintptr(unsafe.Pointer(unsafe.StringData(s)))
+		return s == "" || p >= start && p+uintptr(len(s)) <= start+uintptr(len(source))
+	}
+
+	for _, token := range lexer.Tokens {
+		for _, s := range []string{token.Lexeme, token.Raw, token.LeadingTrivia, token.TrailingTrivia} {
+			if !inSource(s) {
+				t.Fatalf("Expected %q of %s to share the memory of the source", s, token)
+			}
+		}
+	}
+}
+
+// benchGrammar returns a grammar of at least size bytes mixing every kind of token
+func benchGrammar(size int) []byte {
+	rules := []string{
+		"<expr%d> ::= <term> \"+\" <expr> | <term> \"-\" <expr> | <term> !!\n",
+		"<term%d> ::= x=<factor> '*' y=<term> { Mul(x, y) } | <factor>\n",
+		"<factor%d> ::= [0-9]+ | \"(\" <expr> \")\" | [a-zA-Z_] [a-zA-Z0-9_]* # identifiers\n",
+		"<list%d> ::= <item> (\",\" <item>)* [\";\"] &<end> !<error>{2,5}\n",
+		"<string%d> ::= '\"' ([^\"\\\\] | \"\\\\\" <escape>)* '\"' {{ return string(x), nil }}\n",
+	}
+
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(&buf, rules[i%len(rules)], i)
+	}
+
+	return buf.Bytes()
+}
+
+func benchmarkLexer(b *testing.B, newLexer func(src []byte) *Lexer) {
+	src := benchGrammar(4 << 20)
+	b.SetBytes(int64(len(src)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		lexer := newLexer(src)
+		for {
+			token, err := lexer.NextToken()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if token.Type == EndMark {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkLexer_Bytes(b *testing.B) {
+	benchmarkLexer(b, NewBytesLexer)
+}
+
+func BenchmarkLexer_Reader(b *testing.B) {
+	benchmarkLexer(b, func(src []byte) *Lexer {
+		return NewLexer(bytes.NewReader(src))
+	})
+}
+
+func BenchmarkLexer_Stream(b *testing.B) {
+	src := benchGrammar(4 << 20)
+	b.SetBytes(int64(len(src)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		stream := NewBytesLexer(src).Stream(context.Background(), 64)
+		for {
+			token, err := stream.Next()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if token.Type == EndMark {
+				break
+			}
+		}
+		stream.Close()
+	}
+}
+
+// Testing if relexing an edit gives the same tokens as lexing the edited source from scratch
+func TestLexer_Relex(t *testing.T) {
+	lines := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf("<r%d> ::= x=<a> \"b\" ( [a-z]* | <c> ) { Fn(x, [1, \"s\"]) } # c%d", i, i))
+	}
+	src := strings.Join(lines, "\n")
+	middle := strings.Index(src, "<r10>")
+
+	edits := []struct {
+		name string
+		edit Edit
+	}{
+		{"identifier", Edit{middle + 2, middle + 2, "x"}},
+		{"newline", Edit{middle, middle, "<n> ::= <m>\n"}},
+		{"delete", Edit{middle, middle + 20, ""}},
+		{"close", Edit{middle + 4, middle + 5, ""}},
+		{"quote", Edit{middle + 12, middle + 12, "\""}},
+		{"action", Edit{middle + 47, middle + 49, "Mul(y, 2)"}},
+		{"comment", Edit{middle, middle, "(* "}},
+		{"group", Edit{middle + 20, middle + 21, ""}},
+		{"start", Edit{0, 0, " "}},
+		{"end", Edit{len(src), len(src), "\n<z> ::= <y>"}},
+		{"all", Edit{0, len(src), "<a> ::= <b>"}},
+	}
+
+	for _, test := range edits {
+		opts := Options{Recover: true}
+		tokens, err := lexAll(NewStringLexerWithOptions(src, opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		newSrc, updated, change, err := Relex(src, tokens, test.edit, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		expected, err := lexAll(NewStringLexerWithOptions(newSrc, opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(updated) != len(expected) {
+			t.Fatalf("%s: Expected %d tokens, got %d", test.name, len(expected), len(updated))
+		}
+		for i := range expected {
+			e, u := expected[i], updated[i]
+			if e.String() != u.String() || e.Start != u.Start || e.End != u.End || e.Text() != u.Text() || e.Lexeme != u.Lexeme {
+				t.Fatalf("%s: Expected token %d to be %s %s-%s %q, got %s %s-%s %q",
+					test.name, i, e, e.Start, e.End, e.Text(), u, u.Start, u.End, u.Text())
+			}
+		}
+
+		for i := 0; i < change.Start; i++ {
+			if updated[i] != tokens[i] {
+				t.Fatalf("%s: Expected token %d before the change to be kept", test.name, i)
+			}
+		}
+		if len(tokens)-change.OldEnd != len(updated)-change.NewEnd {
+			t.Fatalf("%s: Expected the tokens after the change to be carried over, got %+v", test.name, change)
+		}
+	}
+}
+
+// Testing if an edit only relexes the tokens around it
+func TestLexer_Relex_Range(t *testing.T) {
+	src := strings.Repeat("<a> ::= <b> \"c\"\n", 100)
+	tokens, err := lexAll(NewStringLexer(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := strings.Index(src[800:], "<b>") + 801
+
+	_, updated, change, err := Relex(src, tokens, Edit{offset, offset + 1, "dd"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if change.OldEnd != change.Start+1 || change.NewEnd != change.Start+1 {
+		t.Fatalf("Expected only the edited token to change, got %+v", change)
+	}
+	if updated[change.Start].Lexeme != "dd" {
+		t.Fatalf("Expected <b> to become <dd>, got %+v", change)
+	}
+	if last := updated[len(updated)-1]; last.Type != EndMark || last.End.Offset != len(src)+1 {
+		t.Fatalf("Expected the EndMark to move by one byte, got %s", last.End)
+	}
+
+	if _, _, _, err := Relex(src, tokens, Edit{10, 5, ""}, Options{}); !errors.Is(err, ErrInvalidEdit) {
+		t.Fatalf("Expected ErrInvalidEdit, got %v", err)
+	}
+}
+
+// Testing if the positions of tokens lexed from several files resolve to the right file, line and column
+func TestLexer_FileSet(t *testing.T) {
+	sources := map[string]string{
+		"a.gbnf": "<a> ::= \"é\" <b>\n<b> ::= ü <c>",
+		"b.gbnf": "<c> ::= 日本 <d>\n\n<d> ::= x",
+	}
+	fset := NewFileSet()
+
+	for _, name := range []string{"a.gbnf", "b.gbnf"} {
+		src := sources[name]
+		file := fset.AddFile(name, -1, len(src))
+		lexer := NewStringLexerWithOptions(src, Options{File: file})
+
+		for {
+			token, err := lexer.NextToken()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, pos := range []Position{token.Start, token.End} {
+				if fset.File(pos.Pos) != file {
+					t.Fatalf("Expected %s to be in %s", token, name)
+				}
+				resolved := fset.Position(pos.Pos)
+				if resolved.Filename != name || resolved.Position != pos {
+					t.Fatalf("Expected %s:%s, got %s", name, pos, resolved)
+				}
+			}
+
+			if token.Type == EndMark {
+				break
+			}
+		}
+	}
+
+	if pos := fset.Position(Pos(fset.Base() - 1)); pos.String() != "b.gbnf:3:10" {
+		t.Fatalf("Expected b.gbnf:3:10, got %s", pos)
+	}
+	if pos := fset.Position(NoPos); pos.String() != "-" {
+		t.Fatalf("Expected -, got %s", pos)
+	}
+	if len(fset.Files()) != 2 {
+		t.Fatalf("Expected 2 files, got %d", len(fset.Files()))
+	}
+}
+
+// Testing if positions are resolved while files are being added, run with -race
+func TestLexer_FileSet_Concurrent(t *testing.T) {
+	fset := NewFileSet()
+	first := fset.AddFile("a.gbnf", -1, 10)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10000; i++ {
+			fset.AddFile(fmt.Sprintf("%d.gbnf", i), -1, 10)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10000; i++ {
+			if f := fset.File(Pos(first.base + i%10)); f != first {
+				t.Errorf("Expected a.gbnf, got %v", f)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+// Testing if errors are reported in the file they're in
+func TestLexer_FileSet_Error(t *testing.T) {
+	fset := NewFileSet()
+	fset.AddFile("a.gbnf", -1, 10)
+	src := "<a> ::= \"x"
+	lexer := NewStringLexerWithOptions(src, Options{File: fset.AddFile("b.gbnf", -1, len(src))})
+
+	_, err := lexAll(lexer)
+	var lerr *Error
+	if !errors.As(err, &lerr) {
+		t.Fatalf("Expected *Error, got %v", err)
+	}
+	if pos := fset.Position(lerr.Pos.Pos); pos.String() != "b.gbnf:1:11" || !strings.HasPrefix(lerr.Error(), "b.gbnf:1:11:") {
+		t.Fatalf("Expected the error at b.gbnf:1:11, got %s (%s)", pos, lerr)
+	}
+}
+
+// Testing if CRLF and lone CR end lines, and the input is still reproduced byte for byte
+func TestLexer_LineEndings(t *testing.T) {
+	for _, src := range []string{"<a> ::= <b> # c\r\n<c> ::= d\r\n", "<a> ::= <b> # c\r<c> ::= d\r"} {
+		tokens, err := lexAll(NewStringLexer(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var sb strings.Builder
+		for _, token := range tokens {
+			sb.WriteString(token.Text())
+		}
+		if sb.String() != src {
+			t.Fatalf("Expected %q, got %q", src, sb.String())
+		}
+
+		if tokens[3].Lexeme != "# c" || tokens[3].TrailingTrivia != "" {
+			t.Fatalf("Expected the comment to end before the line break, got %q", tokens[3].Raw+tokens[3].TrailingTrivia)
+		}
+		if c := tokens[4]; c.Lexeme != "c" || c.Start.String() != "2:1" {
+			t.Fatalf("Expected c at 2:1, got %s at %s", c.Lexeme, c.Start)
+		}
+		if end := tokens[len(tokens)-1]; end.Start.String() != "3:1" {
+			t.Fatalf("Expected the EndMark at 3:1, got %s", end.Start)
+		}
+	}
+}
+
+// Testing if a byte order mark and Unicode spaces are skipped as trivia
+func TestLexer_UnicodeSpace(t *testing.T) {
+	src := "\uFEFF<a>\u00A0::=\u3000<b>\u2028x"
+	tokens, err := lexAll(NewStringLexer(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"a", "::=", "b", "x", ""}
+	if len(tokens) != len(expected) {
+		t.Fatalf("Expected %d tokens, got %d", len(expected), len(tokens))
+	}
+	for i, token := range tokens {
+		if token.Lexeme != expected[i] {
+			t.Fatalf("Expected %q, got %q", expected[i], token.Lexeme)
+		}
+	}
+
+	if a := tokens[0]; a.Start.Offset != 3 || a.Start.Column != 1 || a.LeadingTrivia != "\uFEFF" {
+		t.Fatalf("Expected the byte order mark to be leading trivia taking no column, got %s %q", a.Start, a.LeadingTrivia)
+	}
+}
+
+// Testing if columns are counted in the unit asked for, by the lexer and the FileSet alike
+func TestLexer_ColumnUnits(t *testing.T) {
+	src := "<é> ::= <𝒜> x"
+	tests := []struct {
+		unit   ColumnUnit
+		column uint
+	}{
+		{ColumnRunes, 13},
+		{ColumnBytes, 17},
+		{ColumnUTF16, 14},
+	}
+
+	for _, test := range tests {
+		fset := NewFileSet()
+		file := fset.AddFile("a.gbnf", -1, len(src))
+		tokens, err := lexAll(NewStringLexerWithOptions(src, Options{Columns: test.unit, File: file}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		x := tokens[3]
+		if x.Start.Column != test.column {
+			t.Fatalf("Expected x at column %d in %s, got %d", test.column, test.unit, x.Start.Column)
+		}
+		if pos := fset.Position(x.Start.Pos); pos.Position != x.Start {
+			t.Fatalf("Expected %s in %s, got %s", x.Start, test.unit, pos)
+		}
+	}
+
+	lexer := NewStringLexerWithOptions("<é> ::= \"x", Options{Columns: ColumnBytes})
+	_, err := lexAll(lexer)
+	var lerr *Error
+	if !errors.As(err, &lerr) {
+		t.Fatalf("Expected *Error, got %v", err)
+	}
+	if snippet := lerr.Snippet(); snippet != "<é> ::= \"x\n          ^" {
+		t.Fatalf("Expected the caret after x, got\n%s", snippet)
+	}
+}
+
+// Testing if names are normalized when asked to
+func TestLexer_Normalize(t *testing.T) {
+	nfc := strings.NewReplacer("e\u0301", "é").Replace
+	tokens, err := lexAll(NewStringLexerWithOptions("<e\u0301> ::= <é> \"e\u0301\"", Options{Normalize: nfc}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tokens[0].Lexeme != "é" || tokens[2].Lexeme != "é" {
+		t.Fatalf("Expected both names to be é, got %q and %q", tokens[0].Lexeme, tokens[2].Lexeme)
+	}
+	if tokens[0].Raw != "<e\u0301>" {
+		t.Fatalf("Expected the raw text to be kept, got %q", tokens[0].Raw)
+	}
+	if tokens[3].Lexeme != "e\u0301" {
+		t.Fatalf("Expected terminals to be kept as is, got %q", tokens[3].Lexeme)
+	}
+}
@@ -1,12 +1,28 @@
 package lexer
 
 import (
+	"errors"
 	"io"
+	"reflect"
+	"runtime"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type StateFn func(*Lexer) (StateFn, error)
 
+// stateName returns the name of the function implementing a state, e.g. lexString
+func stateName(state StateFn) string {
+	if state == nil {
+		return ""
+	}
+
+	name := runtime.FuncForPC(reflect.ValueOf(state).Pointer()).Name()
+
+	return name[strings.LastIndexByte(name, '.')+1:]
+}
+
 func lexToken(l *Lexer) (StateFn, error) {
 	r, err := l.peekChar()
 	if err != nil {
@@ -16,35 +32,272 @@ func lexToken(l *Lexer) (StateFn, error) {
 		return nil, err
 	}
 
+	l.markStart()
+
+	// Operators that depend on the dialect come first, so they can take over runes that
+	// would otherwise start something else, like ";" or "="
+	d := l.dialect
+	switch {
+	case !l.mayStartOperator():
+		break
+	case matchPrefix(l, d.LineComments) != "":
+		return lexLineComment, nil
+	case matchBlockComment(l) >= 0:
+		return lexBlockComment, nil
+	case matchPrefix(l, d.Terminators) != "":
+		return lexEndOfRule, nil
+	case matchPrefix(l, d.Extend) != "":
+		return lexExtend, nil
+	case matchPrefix(l, d.Assign) != "":
+		return lexAssignment, nil
+	case matchPrefix(l, d.Or) != "":
+		return lexOr, nil
+	case matchPrefix(l, d.Separators) != "":
+		return lexSeparator, nil
+	}
+
 	var state StateFn
 	switch r {
 	case '!':
-		state = lexEndOfRule
-	case ':':
-		state = lexAssignment
-	case '|':
-		state = lexOr
+		state = lexNot
 	case '=':
 		state = lexAssign
 	case '.':
 		state = lexSequence
 	case '&':
 		state = lexAnd
-	case ' ', '\t', '\n':
+	case ' ', '\t', '\n', '\r':
 		state = lexWhitespace
-	case '"', '\'', '<', '{', '[', '(':
+	case '[':
+		if isCharClass(l) {
+			state = lexCharClass
+		} else {
+			state = lexEnclosedLeft
+		}
+	case '*', '+', '?':
+		if isPostfix(l) {
+			state = lexRepetition
+		} else {
+			state = lexTerminalSymbol
+		}
+	case '}':
+		if d.BraceRepetition {
+			state = lexEnclosedRight
+		} else {
+			state = lexTerminalSymbol
+		}
+	case '{':
+		if isPostfix(l) && isBoundedRepetition(l) {
+			state = lexBoundedRepetition
+		} else {
+			state = lexEnclosedLeft
+		}
+	case '<':
+		if d.AngleNonTerminals {
+			state = lexEnclosedLeft
+		} else {
+			state = lexTerminalSymbol
+		}
+	case '"', '\'', '(':
 		state = lexEnclosedLeft
+	case ']', ')':
+		state = lexEnclosedRight
 	default:
-		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+		if isSpace(r) || r == bom && l.pos.Offset == 0 {
+			state = lexWhitespace
+		} else if startsAny(r, d.Assign) {
+			// Part of an assignment operator, lexAssignment reports what's missing
+			state = lexAssignment
+		} else if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
 			state = lexTerminalSymbol
 		} else {
-			return nil, ErrUnexpectedRune
+			return nil, l.newError(ErrUnexpectedRune, r)
 		}
 	}
 
 	return state, nil
 }
 
+// lexInvalid is entered after an error in recovery mode. It skips to the next synchronization
+// point, whitespace, an assignment operator or a rule terminator like "::=" and "!!", and emits
+// everything read since the start of the broken token as an Invalid token
+func lexInvalid(l *Lexer) (StateFn, error) {
+	// Make sure the lexer moves forward even when the error is right at a synchronization point
+	if l.pos == l.start {
+		if err := advanceChar(l); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	for !atSyncPoint(l) {
+		if err := advanceChar(l); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+	}
+
+	l.emitSpan(l.rawStart, l.pos.Offset, Invalid)
+	l.stateStk.Clear()
+	l.actionStk.Clear()
+
+	return lexToken, nil
+}
+
+func atSyncPoint(l *Lexer) bool {
+	r, err := l.peekChar()
+	if err != nil {
+		return true
+	}
+	if isSpace(r) {
+		return true
+	}
+
+	return matchPrefix(l, l.dialect.Assign) != "" || matchPrefix(l, l.dialect.Terminators) != ""
+}
+
+// isPostfix reports whether the rune at the current position directly follows an operand,
+// with no whitespace in between. That's what tells <a>* apart from a bare * terminal
+func isPostfix(l *Lexer) bool {
+	if l.prev == nil || l.prev.End.Offset != l.pos.Offset {
+		return false
+	}
+
+	switch l.prev.Type {
+	case NonTerminalSymbol, TerminalSymbol, CharClass, ParenRight, BracketRight, BraceRight,
+		ZeroOrMore, OneOrMore, ZeroOrOne, Repeat:
+		return true
+	}
+
+	return false
+}
+
+// Upper limit for the bounds of {m,n}, so they can't overflow
+const maxRepetition = 1 << 20
+
+// isBoundedRepetition reports whether the input starts with a brace holding only digits, commas
+// and spaces, like {n}, {m,}, {,n} or {m,n}. Anything else after a brace is an action, the bounds
+// that don't make sense are left to lexBoundedRepetition to report
+func isBoundedRepetition(l *Lexer) bool {
+	next, _ := l.Peek(classLookahead)
+
+	bounds := false
+	for _, b := range next[1:] {
+		switch {
+		case b >= '0' && b <= '9' || b == ',':
+			bounds = true
+		case b == ' ':
+		case b == '}':
+			return bounds
+		default:
+			return false
+		}
+	}
+
+	return false
+}
+
+func lexRepetition(l *Lexer) (StateFn, error) {
+	r, err := l.nextChar()
+	if err != nil {
+		return nil, err
+	}
+
+	switch r {
+	case '*':
+		l.emitToken(ZeroOrMore)
+	case '+':
+		l.emitToken(OneOrMore)
+	case '?':
+		l.emitToken(ZeroOrOne)
+	default:
+		return nil, ErrUnexpectedRune
+	}
+
+	return lexToken, nil
+}
+
+// lexBoundedRepetition reads {n}, {m,}, {,n} or {m,n}, isBoundedRepetition already found the
+// closing brace
+func lexBoundedRepetition(l *Lexer) (StateFn, error) {
+	for {
+		r, err := l.nextChar()
+		if err != nil {
+			return nil, err
+		}
+		if r == '}' {
+			break
+		}
+	}
+
+	// The bounds are ASCII, so the offending byte is as many columns away as bytes
+	lexeme := l.lexeme()
+	if _, _, bad, err := parseRepeat(lexeme[1 : len(lexeme)-1]); err != nil {
+		at := l.start
+		at.Offset += 1 + bad
+		at.Column += uint(1 + bad)
+		return nil, relocate(l.newError(err, rune(lexeme[1+bad])), l.global(at))
+	}
+
+	l.emitToken(Repeat)
+
+	return lexToken, nil
+}
+
+// RepeatBounds returns the bounds of a Repeat token, max is -1 when there's no upper bound.
+// They're parsed like the lexer does, ErrInvalidRepetition tells the lexeme isn't a repetition
+func RepeatBounds(t *Token) (min, max int, err error) {
+	body, open := strings.CutPrefix(t.Lexeme, "{")
+	body, closed := strings.CutSuffix(body, "}")
+	if !open || !closed {
+		return 0, 0, ErrInvalidRepetition
+	}
+	min, max, _, err = parseRepeat(body)
+
+	return min, max, err
+}
+
+// parseRepeat parses the bounds between the braces of {n}, {m,}, {,n} or {m,n}, spaces are allowed
+// around the numbers but not inside them. When the bounds are invalid, bad is the index in body
+// of the byte in the way, len(body) if it's the closing brace
+func parseRepeat(body string) (min, max, bad int, err error) {
+	min, max = -1, -1
+	bound, comma := &min, false
+	for i := 0; i < len(body); i++ {
+		switch b := body[i]; {
+		case b == ' ':
+		case b == ',' && !comma:
+			bound, comma = &max, true
+		case b >= '0' && b <= '9' && *bound < 0:
+			*bound = 0
+			for ; i < len(body) && body[i] >= '0' && body[i] <= '9'; i++ {
+				if *bound = *bound*10 + int(body[i]-'0'); *bound > maxRepetition {
+					return 0, 0, i, ErrInvalidRepetition
+				}
+			}
+			i--
+		default:
+			return 0, 0, i, ErrInvalidRepetition
+		}
+	}
+
+	if min < 0 && max < 0 {
+		return 0, 0, len(body), ErrInvalidRepetition
+	}
+	if !comma {
+		max = min
+	}
+	if min < 0 {
+		min = 0
+	}
+	if max >= 0 && max < min {
+		return 0, 0, len(body), ErrInvalidRepetition
+	}
+
+	return min, max, -1, nil
+}
+
 func lexAnd(l *Lexer) (StateFn, error) {
 	if err := advanceChar(l); err != nil {
 		return nil, err
@@ -55,22 +308,19 @@ func lexAnd(l *Lexer) (StateFn, error) {
 	return lexToken, nil
 }
 
-func lexEndOfRule(l *Lexer) (StateFn, error) {
+func lexNot(l *Lexer) (StateFn, error) {
 	if err := advanceChar(l); err != nil {
 		return nil, err
 	}
 
-	if err := expectChar(l, '!'); err != nil {
-		if err == ErrUnexpectedRune {
-			l.emitToken(Not)
-			return lexToken, nil
-		}
-		return nil, err
-	}
+	l.emitToken(Not)
 
-	if err := advanceIfChar(l, func(r rune) bool {
-		return r == '!'
-	}); err != nil {
+	return lexToken, nil
+}
+
+// lexEndOfRule reads one of the terminators of the dialect, "!!" by default
+func lexEndOfRule(l *Lexer) (StateFn, error) {
+	if err := advanceOperator(l, matchPrefix(l, l.dialect.Terminators)); err != nil {
 		return nil, err
 	}
 
@@ -79,6 +329,15 @@ func lexEndOfRule(l *Lexer) (StateFn, error) {
 	return lexToken, nil
 }
 
+// lexSeparator skips a separator of the dialect, e.g. the commas of ISO EBNF
+func lexSeparator(l *Lexer) (StateFn, error) {
+	if err := advanceOperator(l, matchPrefix(l, l.dialect.Separators)); err != nil {
+		return nil, err
+	}
+
+	return lexToken, nil
+}
+
 func lexSequence(l *Lexer) (StateFn, error) {
 
 	if err := advanceChar(l); err != nil {
@@ -110,69 +369,336 @@ func lexAssign(l *Lexer) (StateFn, error) {
 	return lexToken, nil
 }
 
+// lexAction reads the call at the top of an action, { Fn(args) }. The arguments are read by
+// lexActionArg, which emits:
+//
+//	Action         the name of a call, nested calls included, the "(" is consumed with it
+//	ActionArg      a reference to a label, x
+//	ActionString   a quoted string, escape sequences are decoded
+//	ActionNumber   an integer or decimal number, -1 or 2.5
+//	ActionList     the "[" starting a list argument, [x, y]
+//	ActionListEnd  the "]" ending a list argument
+//	ActionCallEnd  the ")" ending a call
 func lexAction(l *Lexer) (StateFn, error) {
-	if err := skipWhitespace(l); err != nil {
+	if err := skipActionWhitespace(l, '}'); err != nil {
 		return nil, err
 	}
 
-	l.clearRuneTmpBuffer()
-
-	if err := readNextCharWhile(l, func(r rune) bool {
-		return r != '('
-	}); err != nil {
+	if err := readActionName(l); err != nil {
 		return nil, err
 	}
+	if !hasPrefix(l, "(") {
+		r, _ := l.peekChar()
+		return nil, l.newError(ErrUnexpectedRune, r, '(')
+	}
 
-	l.emitToken(Action)
-	l.clearRuneTmpBuffer()
+	return lexActionArg, emitActionCall(l)
+}
+
+// emitActionCall reads the "(" of a call whose name was just read and emits the call
+func emitActionCall(l *Lexer) error {
+	name := l.lexeme()
 
 	if err := advanceChar(l); err != nil {
-		return nil, err
+		return err
 	}
+	l.emitTokenOpts(name, l.start, l.pos, Action)
+	l.actionStk.Push(')')
 
-	// l.emitToken(ParenLeft)
-
-	return lexActionArg, nil
+	return nil
 }
 
 func lexActionArg(l *Lexer) (StateFn, error) {
-	if err := skipWhitespace(l); err != nil {
+	if err := skipActionWhitespace(l, l.actionStk.Peek()); err != nil {
 		return nil, err
 	}
 
-	var last rune
-	if err := readNextCharWhile(l, func(r rune) bool {
-		last = r
-		return r != ')' && r != ',' && r != ' ' && r != '\t'
-	}); err != nil {
+	r, err := l.peekChar()
+	if err != nil {
 		return nil, err
 	}
 
-	switch last {
-	case ')':
-		if len(l.runeTmpBuffer) > 0 {
-			l.emitToken(ActionArg)
+	switch {
+	case r == ')' || r == ']':
+		return lexActionClose, nil
+	case r == '[':
+		if err := advanceChar(l); err != nil {
+			return nil, err
 		}
-		break
-	case ',', ' ', '\t':
-		if len(l.runeTmpBuffer) > 0 {
-			l.emitToken(ActionArg)
+		l.emitToken(ActionList)
+		l.actionStk.Push(']')
+		return lexActionArg, nil
+	case r == '"' || r == '\'':
+		if err := advanceChar(l); err != nil {
+			return nil, err
 		}
-		if err := advanceCharN(l, 2); err != nil {
+		value, err := readQuoted(l, r)
+		if err != nil {
+			return nil, err
+		}
+		l.emitTokenOpts(value, l.start, l.pos, ActionString)
+		return lexActionSeparator, nil
+	case r == '-' || unicode.IsDigit(r):
+		return lexActionNumber, nil
+	case unicode.IsLetter(r) || r == '_':
+		if err := readActionName(l); err != nil {
+			return nil, err
+		}
+		if hasPrefix(l, "(") {
+			return lexActionArg, emitActionCall(l)
+		}
+		l.emitToken(ActionArg)
+		return lexActionSeparator, nil
+	}
+
+	return nil, l.newError(ErrUnexpectedRune, r, l.actionStk.Peek())
+}
+
+// lexActionSeparator reads what comes after an argument, a "," or the end of the enclosing call or list
+func lexActionSeparator(l *Lexer) (StateFn, error) {
+	closing := l.actionStk.Peek()
+	if err := skipActionWhitespace(l, closing); err != nil {
+		return nil, err
+	}
+
+	r, err := l.peekChar()
+	if err != nil {
+		return nil, err
+	}
+
+	switch r {
+	case ',':
+		if err := advanceChar(l); err != nil {
 			return nil, err
 		}
 		return lexActionArg, nil
+	case closing:
+		return lexActionClose, nil
+	}
+
+	return nil, l.newError(ErrUnexpectedRune, r, ',', closing)
+}
+
+// lexActionClose reads the ")" or "]" closing the innermost call or list
+func lexActionClose(l *Lexer) (StateFn, error) {
+	closing := l.actionStk.Pop()
+	if err := expectChar(l, closing); err != nil {
+		return nil, err
+	}
+	if err := advanceChar(l); err != nil {
+		return nil, err
+	}
+
+	if closing == ']' {
+		l.emitToken(ActionListEnd)
+	} else {
+		l.emitToken(ActionCallEnd)
+	}
+
+	if l.actionStk.Empty() {
+		return lexActionRight, nil
+	}
+
+	return lexActionSeparator, nil
+}
+
+func lexActionNumber(l *Lexer) (StateFn, error) {
+	if err := advanceIfChar(l, func(r rune) bool {
+		return r == '-'
+	}); err != nil {
+		return nil, err
+	}
+	if err := readDigits(l); err != nil {
+		return nil, err
+	}
+	if hasPrefix(l, ".") {
+		if err := advanceChar(l); err != nil {
+			return nil, err
+		}
+		if err := readDigits(l); err != nil {
+			return nil, err
+		}
+	}
+
+	l.emitToken(ActionNumber)
+
+	return lexActionSeparator, nil
+}
+
+// readDigits consumes one or more decimal digits
+func readDigits(l *Lexer) error {
+	r, err := l.peekChar()
+	if err != nil {
+		if err == io.EOF {
+			return l.newError(ErrUnexpectedEOF, EOF)
+		}
+		return err
+	}
+	if !unicode.IsDigit(r) {
+		return l.newError(ErrUnexpectedRune, r)
+	}
+
+	if err := readNextCharWhile(l, unicode.IsDigit); err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// readActionName reads the name of a call or a label, dots are allowed so calls can be qualified
+func readActionName(l *Lexer) error {
+	r, err := l.peekChar()
+	if err != nil {
+		if err == io.EOF {
+			return l.newError(ErrUnexpectedEOF, EOF)
+		}
+		return err
+	}
+	if !unicode.IsLetter(r) && r != '_' {
+		return l.newError(ErrUnexpectedRune, r)
+	}
+
+	err = readNextCharWhile(l, func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.'
+	})
+	if err == io.EOF {
+		return l.newError(ErrUnexpectedEOF, EOF, '(')
+	}
+
+	return err
+}
+
+// skipActionWhitespace skips whitespace inside an action and marks the start of the next token.
+// The input can't end inside an action, so EOF is reported as an error expecting closing
+func skipActionWhitespace(l *Lexer, closing rune) error {
+	if err := skipWhitespace(l); err != nil {
+		if err == io.EOF {
+			return l.newError(ErrUnexpectedEOF, EOF, closing)
+		}
+		return err
+	}
+
+	l.clearRuneTmpBuffer()
+	l.markStart()
+
+	return nil
+}
+
+// lexActionRight consumes the closing brace of an action, so it doesn't end up as a terminal symbol
+func lexActionRight(l *Lexer) (StateFn, error) {
+	if err := skipWhitespace(l); err != nil {
+		if err == io.EOF {
+			return nil, l.newError(ErrUnexpectedEOF, EOF, '}')
+		}
+		return nil, err
+	}
+
+	if err := expectChar(l, '}'); err != nil {
+		return nil, err
 	}
 
 	if err := advanceChar(l); err != nil {
 		return nil, err
 	}
 
-	// l.emitTokenOpts(string(l.runeTmpBuffer[len(l.runeTmpBuffer)-1]), l.line, l.column, ParenRight)
+	return lexToken, nil
+}
+
+// lexCodeBlock reads raw code between {{ and }}. Braces in the code must be balanced, braces inside
+// Go strings, rune literals and comments don't count
+func lexCodeBlock(l *Lexer) (StateFn, error) {
+	if err := advanceChar(l); err != nil {
+		return nil, err
+	}
+	l.clearRuneTmpBuffer()
+
+	depth := 0
+	for depth > 0 || !hasPrefix(l, "}}") {
+		at := l.pos
+		r, err := l.nextChar()
+		if err != nil {
+			if err == io.EOF {
+				return nil, l.newError(ErrUnexpectedEOF, EOF, '}')
+			}
+			return nil, err
+		}
+
+		switch r {
+		case '{':
+			depth++
+		case '}':
+			// A brace closing nothing would make the block end at the wrong "}}"
+			if depth--; depth < 0 {
+				return nil, relocate(l.newError(ErrUnexpectedRune, r), l.global(at))
+			}
+		case '"', '\'':
+			err = skipCodeString(l, r, true)
+		case '`':
+			err = skipCodeString(l, r, false)
+		case '/':
+			if hasPrefix(l, "/") {
+				err = skipCodeUntil(l, "\n", false)
+			} else if hasPrefix(l, "*") {
+				err = skipCodeUntil(l, "*/", true)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	code := l.lexeme()
+	if err := advanceCharN(l, 2); err != nil {
+		return nil, err
+	}
+	l.emitTokenOpts(strings.TrimSpace(code), l.start, l.pos, CodeBlock)
 
 	return lexToken, nil
 }
 
+// skipCodeString skips the rest of a string or rune literal in a code block
+func skipCodeString(l *Lexer, quote rune, escapes bool) error {
+	for {
+		r, err := l.nextChar()
+		if err != nil {
+			if err == io.EOF {
+				return l.newError(ErrUnexpectedEOF, EOF, quote)
+			}
+			return err
+		}
+
+		switch {
+		case r == quote:
+			return nil
+		case r == '\\' && escapes:
+			if _, err := l.nextChar(); err != nil {
+				if err == io.EOF {
+					return l.newError(ErrUnexpectedEOF, EOF, quote)
+				}
+				return err
+			}
+		}
+	}
+}
+
+// skipCodeUntil skips a comment in a code block up to and including end. Line comments may end
+// the input, block comments must be closed
+func skipCodeUntil(l *Lexer, end string, required bool) error {
+	for !hasPrefix(l, end) {
+		if _, err := l.nextChar(); err != nil {
+			if err == io.EOF && required {
+				return l.newError(ErrUnexpectedEOF, EOF, []rune(end)...)
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+
+	return advanceOperator(l, end)
+}
+
 func lexEnclosedLeft(l *Lexer) (StateFn, error) {
 	r1, err := l.nextChar()
 	if err != nil {
@@ -182,6 +708,13 @@ func lexEnclosedLeft(l *Lexer) (StateFn, error) {
 
 	switch r1 {
 	case '{':
+		if l.dialect.BraceRepetition {
+			l.runeStk.Push(r1)
+			return lexGroup, nil
+		}
+		if hasPrefix(l, "{") {
+			return lexCodeBlock, nil
+		}
 		return lexAction, nil
 	case '"', '\'', '<':
 		if r1 == '<' {
@@ -199,17 +732,22 @@ func lexEnclosedLeft(l *Lexer) (StateFn, error) {
 }
 
 func lexEnclosedRight(l *Lexer) (StateFn, error) {
-	opening := l.runeStk.Pop()
+	// lexGroup leaves the closing rune of the innermost group on the stack
+	expected := l.runeStk.Pop()
 
-	var expected rune
+	var typ TokenType
 
-	switch opening {
-	case '(':
-		expected = ')'
-	case '[':
-		expected = ']'
+	switch expected {
+	case ')':
+		typ = ParenRight
+	case ']':
+		typ = BracketRight
+	case '}':
+		typ = BraceRight
 	default:
-		return nil, ErrUnexpectedRune
+		// There's no open group to close
+		r, _ := l.peekChar()
+		return nil, l.newError(ErrUnexpectedRune, r)
 	}
 
 	if err := expectChar(l, expected); err != nil {
@@ -220,14 +758,23 @@ func lexEnclosedRight(l *Lexer) (StateFn, error) {
 		return nil, err
 	}
 
+	l.emitToken(typ)
+
 	return lexToken, nil
 }
 
 func lexString(l *Lexer) (StateFn, error) {
 	expected := l.runeStk.Pop()
+	if expected != '>' {
+		return lexQuoted(l, expected)
+	}
+
 	if err := readNextCharWhile(l, func(r rune) bool {
 		return r != expected
 	}); err != nil {
+		if err == io.EOF {
+			return nil, l.newError(ErrUnexpectedEOF, EOF, expected)
+		}
 		return nil, err
 	}
 
@@ -235,32 +782,357 @@ func lexString(l *Lexer) (StateFn, error) {
 		return nil, err
 	}
 
-	if expected == '>' {
-		l.emitToken(NonTerminalSymbol)
-	} else {
-		l.emitToken(TerminalSymbol)
+	end := l.pos.Offset
+
+	if err := advanceChar(l); err != nil {
+		return nil, err
 	}
 
-	if err := advanceIfChar(l, func(r rune) bool {
-		return r == expected
-	}); err != nil {
+	// The range of the token covers the delimiters, the lexeme doesn't
+	l.emitSpan(l.lexemeStart, end, NonTerminalSymbol)
+
+	return lexToken, nil
+}
+
+// lexQuoted reads a terminal enclosed in quotes, the escape sequences are decoded into the lexeme
+func lexQuoted(l *Lexer, quote rune) (StateFn, error) {
+	value, err := readQuoted(l, quote)
+	if err != nil {
 		return nil, err
 	}
 
+	l.emitTokenOpts(value, l.start, l.pos, TerminalSymbol)
+
 	return lexToken, nil
 }
 
+// readQuoted reads up to and including the closing quote, the opening one was already consumed.
+// Strings don't span lines: a line break before the closing quote is reported at the opening one
+// and left unread, so recovery picks up on the next line
+func readQuoted(l *Lexer, quote rune) (string, error) {
+	// The value is the source text unless there are escapes to decode
+	from := l.pos.Offset
+	var value []rune
+
+	// Quotes are ASCII, one byte and one column in any unit
+	open := l.pos
+	open.Offset--
+	open.Column--
+
+	for {
+		r, err := l.peekChar()
+		if err != nil {
+			if err == io.EOF {
+				return "", l.newError(ErrUnexpectedEOF, EOF, quote)
+			}
+			return "", err
+		}
+		if r == quote {
+			break
+		}
+		if r == '\n' || r == '\r' {
+			return "", relocate(l.newError(ErrUnterminatedString, quote), l.global(open))
+		}
+
+		if r == '\\' {
+			if value == nil {
+				value = []rune(l.text(from, l.pos.Offset))
+			}
+			r, err = readEscape(l, `\"'`)
+			if err != nil {
+				return "", err
+			}
+			value = append(value, r)
+		} else {
+			if err := advanceChar(l); err != nil {
+				return "", err
+			}
+			if value != nil {
+				value = append(value, r)
+			}
+		}
+	}
+
+	text := l.text(from, l.pos.Offset)
+	if err := advanceChar(l); err != nil {
+		return "", err
+	}
+	if value != nil {
+		text = string(value)
+	}
+
+	return text, nil
+}
+
+// readEscape consumes an escape sequence and returns the rune it stands for.
+// The supported sequences are \n, \t, \r, \xHH, \uHHHH and \u{H...}, plus a backslash followed
+// by any of the runes in literal, which stands for the rune itself
+func readEscape(l *Lexer, literal string) (rune, error) {
+	start := l.pos
+
+	if err := advanceChar(l); err != nil {
+		return 0, err
+	}
+
+	r, err := l.nextChar()
+	if err != nil {
+		if err == io.EOF {
+			return 0, escapeError(l, start, ErrUnexpectedEOF, EOF)
+		}
+		return 0, err
+	}
+
+	if strings.ContainsRune(literal, r) {
+		return r, nil
+	}
+
+	switch r {
+	case 'n':
+		return '\n', nil
+	case 't':
+		return '\t', nil
+	case 'r':
+		return '\r', nil
+	case 'x':
+		return readHexEscape(l, start, 2)
+	case 'u':
+		if !hasPrefix(l, "{") {
+			return readHexEscape(l, start, 4)
+		}
+		if err := advanceChar(l); err != nil {
+			return 0, err
+		}
+		v, err := readHexEscape(l, start, -6)
+		if err != nil {
+			return 0, err
+		}
+		if err := expectChar(l, '}'); err != nil {
+			return 0, relocate(err, start)
+		}
+		if err := advanceChar(l); err != nil {
+			return 0, err
+		}
+		return v, nil
+	}
+
+	expected := append([]rune(literal), 'n', 't', 'r', 'x', 'u')
+	return 0, escapeError(l, start, ErrInvalidEscape, r, expected...)
+}
+
+// readHexEscape reads n hex digits, or between 1 and -n digits when n is negative
+func readHexEscape(l *Lexer, start Position, n int) (rune, error) {
+	min, max := n, n
+	if n < 0 {
+		min, max = 1, -n
+	}
+
+	var v rune
+	digits := 0
+	for digits < max {
+		r, err := l.peekChar()
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		d := hexDigit(r)
+		if err == io.EOF || d < 0 {
+			if digits >= min {
+				break
+			}
+			if err == io.EOF {
+				return 0, escapeError(l, start, ErrUnexpectedEOF, EOF)
+			}
+			return 0, escapeError(l, start, ErrInvalidEscape, r)
+		}
+		if err := advanceChar(l); err != nil {
+			return 0, err
+		}
+		v = v*16 + rune(d)
+		digits++
+	}
+
+	if v > unicode.MaxRune || (v >= 0xD800 && v <= 0xDFFF) {
+		return 0, escapeError(l, start, ErrInvalidEscape, v)
+	}
+
+	return v, nil
+}
+
+func hexDigit(r rune) int {
+	switch {
+	case r >= '0' && r <= '9':
+		return int(r - '0')
+	case r >= 'a' && r <= 'f':
+		return int(r-'a') + 10
+	case r >= 'A' && r <= 'F':
+		return int(r-'A') + 10
+	}
+
+	return -1
+}
+
+// escapeError reports an error located at the backslash that starts the escape sequence
+func escapeError(l *Lexer, start Position, err error, r rune, expected ...rune) error {
+	return relocate(l.newError(err, r, expected...), start)
+}
+
+func relocate(err error, pos Position) error {
+	var lerr *Error
+	if errors.As(err, &lerr) {
+		lerr.Pos = pos
+	}
+
+	return err
+}
+
+// lexCharClass reads a character class like [a-z0-9_], [^"] or [\p{L}\-] into a CharSet
+func lexCharClass(l *Lexer) (StateFn, error) {
+	if err := advanceChar(l); err != nil {
+		return nil, err
+	}
+
+	set := &CharSet{
+		Ranges:  make([]CharRange, 0, 2),
+		Classes: make([]UnicodeClass, 0),
+	}
+	if hasPrefix(l, "^") {
+		set.Negated = true
+		if err := advanceChar(l); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		r, err := l.peekChar()
+		if err != nil {
+			if err == io.EOF {
+				return nil, l.newError(ErrUnexpectedEOF, EOF, ']')
+			}
+			return nil, err
+		}
+
+		switch {
+		case r == ']':
+			if len(set.Ranges) == 0 && len(set.Classes) == 0 {
+				return nil, l.newError(ErrInvalidClass, r)
+			}
+			if err := advanceChar(l); err != nil {
+				return nil, err
+			}
+			l.emitSpan(l.rawStart, l.pos.Offset, CharClass)
+			l.Tokens[len(l.Tokens)-1].Set = set
+			return lexToken, nil
+		case r == '\n' || r == '\r':
+			return nil, l.newError(ErrUnexpectedRune, r, ']')
+		case hasPrefix(l, `\p`) || hasPrefix(l, `\P`):
+			class, err := readUnicodeClass(l)
+			if err != nil {
+				return nil, err
+			}
+			set.Classes = append(set.Classes, class)
+			continue
+		}
+
+		lo, err := readClassRune(l)
+		if err != nil {
+			return nil, err
+		}
+		hi := lo
+		if hasPrefix(l, "-") && !hasPrefix(l, "-]") {
+			if err := advanceChar(l); err != nil {
+				return nil, err
+			}
+			if hi, err = readClassRune(l); err != nil {
+				return nil, err
+			}
+		}
+		set.Ranges = append(set.Ranges, CharRange{Lo: lo, Hi: hi})
+	}
+}
+
+func readClassRune(l *Lexer) (rune, error) {
+	r, err := l.peekChar()
+	if err != nil {
+		if err == io.EOF {
+			return 0, l.newError(ErrUnexpectedEOF, EOF, ']')
+		}
+		return 0, err
+	}
+	if r == '\\' {
+		return readEscape(l, `\"'[]-^`)
+	}
+	if err := advanceChar(l); err != nil {
+		return 0, err
+	}
+
+	return r, nil
+}
+
+// readUnicodeClass reads \p{Name}, \P{Name} or the one letter forms \pL and \PL
+func readUnicodeClass(l *Lexer) (UnicodeClass, error) {
+	start := l.pos
+	if err := advanceChar(l); err != nil {
+		return UnicodeClass{}, err
+	}
+	p, err := l.nextChar()
+	if err != nil {
+		return UnicodeClass{}, err
+	}
+	class := UnicodeClass{Negated: p == 'P'}
+
+	if !hasPrefix(l, "{") {
+		r, err := l.nextChar()
+		if err != nil {
+			return UnicodeClass{}, escapeError(l, start, ErrUnexpectedEOF, EOF)
+		}
+		class.Name = string(r)
+	} else {
+		if err := advanceChar(l); err != nil {
+			return UnicodeClass{}, err
+		}
+		name := make([]rune, 0, 8)
+		for {
+			r, err := l.peekChar()
+			if err != nil {
+				return UnicodeClass{}, escapeError(l, start, ErrUnexpectedEOF, EOF, '}')
+			}
+			if r == '}' {
+				break
+			}
+			if !unicode.IsLetter(r) && r != '_' {
+				return UnicodeClass{}, escapeError(l, start, ErrInvalidClass, r, '}')
+			}
+			if err := advanceChar(l); err != nil {
+				return UnicodeClass{}, err
+			}
+			name = append(name, r)
+		}
+		if err := advanceChar(l); err != nil {
+			return UnicodeClass{}, err
+		}
+		class.Name = string(name)
+	}
+
+	if unicodeTable(class.Name) == nil {
+		return UnicodeClass{}, escapeError(l, start, ErrInvalidClass, p)
+	}
+
+	return class, nil
+}
+
 func lexGroup(l *Lexer) (StateFn, error) {
 	opening := l.runeStk.Pop()
 	var closing rune
 
 	switch opening {
 	case '[':
-		l.emitTokenOpts("[", l.line, l.column, BracketLeft)
+		l.emitTokenOpts("[", l.start, l.pos, BracketLeft)
 		closing = ']'
 	case '(':
-		l.emitTokenOpts("(", l.line, l.column, ParenLeft)
+		l.emitTokenOpts("(", l.start, l.pos, ParenLeft)
 		closing = ')'
+	case '{':
+		l.emitTokenOpts("{", l.start, l.pos, BraceLeft)
+		closing = '}'
 	default:
 		return nil, ErrUnexpectedRune
 	}
@@ -276,6 +1148,10 @@ func lexTerminalSymbol(l *Lexer) (StateFn, error) {
 		return nil, err
 	}
 
+	if l.dialect.BareNonTerminals && (unicode.IsLetter(r) || r == '_') {
+		return lexIdentifier(l)
+	}
+
 	if unicode.IsLetter(r) || unicode.IsDigit(r) {
 		err := readNextCharWhile(l, func(r rune) bool {
 			return unicode.IsLetter(r) || unicode.IsDigit(r)
@@ -304,44 +1180,97 @@ func lexTerminalSymbol(l *Lexer) (StateFn, error) {
 	return lexToken, nil
 }
 
-func lexAssignment(l *Lexer) (StateFn, error) {
-	r, err := l.nextChar()
-	if err != nil {
+// lexIdentifier reads the rest of a bare non-terminal, letters, digits, "_" and "-"
+func lexIdentifier(l *Lexer) (StateFn, error) {
+	err := readNextCharWhile(l, isIdentifierRune)
+	switch err {
+	case nil:
+		break
+	case io.EOF:
+		l.emitToken(NonTerminalSymbol)
+		return nil, nil
+	default:
 		return nil, err
 	}
-	if r != ':' {
-		return nil, ErrUnexpectedRune
-	}
 
-	r, err = l.nextChar()
-	if err != nil {
-		return nil, err
+	l.emitToken(NonTerminalSymbol)
+
+	return lexToken, nil
+}
+
+func isIdentifierRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-'
+}
+
+// lexAssignment reads the longest assignment operator of the dialect. It's also entered on
+// the first rune of an operator that may be misspelled, like "::" missing its "="
+func lexAssignment(l *Lexer) (StateFn, error) {
+	for {
+		r, err := l.peekChar()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		read := l.text(l.start.Offset, l.pos.Offset)
+		complete, extends := false, false
+		for _, op := range l.dialect.Assign {
+			if op == read {
+				complete = true
+			} else if err == nil && strings.HasPrefix(op, read) {
+				next, _ := utf8.DecodeRuneInString(op[len(read):])
+				extends = extends || next == r
+			}
+		}
+
+		if extends {
+			if err := advanceChar(l); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if complete {
+			break
+		}
+		if err == io.EOF {
+			return nil, l.newError(ErrUnexpectedEOF, EOF, expectedAssign(l, read)...)
+		}
+		return nil, l.newError(ErrUnexpectedRune, r, expectedAssign(l, read)...)
 	}
-	if r != ':' {
-		return nil, ErrUnexpectedRune
+
+	l.emitToken(ProdRule)
+
+	return lexToken, nil
+}
+
+// expectedAssign returns the runes that can follow read in the assignment operators of the dialect
+func expectedAssign(l *Lexer, read string) []rune {
+	next := make([]rune, 0)
+	for _, op := range l.dialect.Assign {
+		if op != read && strings.HasPrefix(op, read) {
+			r, _ := utf8.DecodeRuneInString(op[len(read):])
+			next = append(next, r)
+		}
 	}
 
-	r, err = l.nextChar()
-	if err != nil {
+	return next
+}
+
+// lexExtend reads one of the operators extending a rule, "|=" by default
+func lexExtend(l *Lexer) (StateFn, error) {
+	if err := advanceOperator(l, matchPrefix(l, l.dialect.Extend)); err != nil {
 		return nil, err
 	}
-	if r != '=' {
-		return nil, ErrUnexpectedRune
-	}
 
-	l.emitToken(ProdRule)
+	l.emitToken(Extend)
 
 	return lexToken, nil
 }
 
+// lexOr reads one of the alternative operators of the dialect, "|" by default
 func lexOr(l *Lexer) (StateFn, error) {
-	r, err := l.nextChar()
-	if err != nil {
+	if err := advanceOperator(l, matchPrefix(l, l.dialect.Or)); err != nil {
 		return nil, err
 	}
-	if r != '|' {
-		return nil, ErrUnexpectedRune
-	}
 
 	l.emitToken(Or)
 
@@ -355,3 +1284,70 @@ func lexWhitespace(l *Lexer) (StateFn, error) {
 
 	return lexToken, nil
 }
+
+// lexLineComment reads a comment from one of the prefixes of the dialect up to the end of the line
+func lexLineComment(l *Lexer) (StateFn, error) {
+	err := readNextCharWhile(l, func(r rune) bool {
+		return r != '\n' && r != '\r'
+	})
+	switch err {
+	case nil:
+		break
+	case io.EOF:
+		emitComment(l)
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	emitComment(l)
+
+	return lexToken, nil
+}
+
+// lexBlockComment reads a comment enclosed in delimiters like "(*" and "*)", which may span several lines
+func lexBlockComment(l *Lexer) (StateFn, error) {
+	delims := l.dialect.BlockComments[matchBlockComment(l)]
+	if err := advanceOperator(l, delims[0]); err != nil {
+		return nil, err
+	}
+
+	for !hasPrefix(l, delims[1]) {
+		if err := advanceChar(l); err != nil {
+			if err == io.EOF {
+				return nil, l.newError(ErrUnexpectedEOF, EOF, []rune(delims[1])[0])
+			}
+			return nil, err
+		}
+	}
+
+	if err := advanceOperator(l, delims[1]); err != nil {
+		return nil, err
+	}
+
+	emitComment(l)
+
+	return lexToken, nil
+}
+
+// emitComment emits the comment just read, or keeps it as trivia if the lexer was asked to
+func emitComment(l *Lexer) {
+	if l.CommentsAsTrivia {
+		l.addTrivia(true)
+		return
+	}
+
+	l.emitToken(Comment)
+}
+
+// matchBlockComment returns the index of the block comment delimiters the unread input
+// starts with, or -1
+func matchBlockComment(l *Lexer) int {
+	for i, delims := range l.dialect.BlockComments {
+		if hasPrefix(l, delims[0]) {
+			return i
+		}
+	}
+
+	return -1
+}
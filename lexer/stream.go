@@ -0,0 +1,194 @@
+package lexer
+
+import (
+	"context"
+	"io"
+)
+
+// Stream lexes in its own goroutine and hands the tokens over through a bounded channel,
+// so the lexer can't get more than the size of the channel ahead of the consumer.
+// Tokens are dropped once they're consumed, unless a mark is holding them, see Mark
+type Stream struct {
+	items  chan streamItem
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Tokens received and still retained, window[0] is the token at index base of the stream
+	window []*Token
+	base   int
+	// Index of the next token returned by Next
+	next int
+	// Active marks, oldest first
+	marks []int
+	// Error that ended the stream, returned by Next once the window is exhausted
+	err error
+}
+
+type streamItem struct {
+	token *Token
+	err   error
+}
+
+// Stream starts lexing in a new goroutine and returns the stream of tokens.
+// The lexer must not be used by the caller afterwards, and Lexer.Tokens doesn't grow anymore.
+// Errors collected in recovery mode can be read from Lexer.Errors once the stream returned EndMark.
+// Cancelling ctx or calling Close stops the goroutine
+func (l *Lexer) Stream(ctx context.Context, size int) *Stream {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Stream{
+		items:  make(chan streamItem, size),
+		ctx:    ctx,
+		cancel: cancel,
+		window: make([]*Token, 0),
+	}
+
+	l.discard = true
+	go s.run(ctx, l)
+
+	return s
+}
+
+func (s *Stream) run(ctx context.Context, l *Lexer) {
+	defer close(s.items)
+
+	send := func(item streamItem) bool {
+		select {
+		case s.items <- item:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	// A token is held back until the next one is lexed, that's when its trailing trivia is known
+	var held *Token
+	for {
+		if err := ctx.Err(); err != nil {
+			send(streamItem{err: err})
+			return
+		}
+
+		token, err := l.NextToken()
+		if err != nil {
+			if held == nil || send(streamItem{token: held}) {
+				send(streamItem{err: err})
+			}
+			return
+		}
+		if token == nil {
+			token = NewToken("", l.pos, l.pos, EndMark)
+		}
+
+		if held != nil && !send(streamItem{token: held}) {
+			return
+		}
+		held = token
+
+		if token.Type == EndMark {
+			send(streamItem{token: held})
+			return
+		}
+	}
+}
+
+// Next returns the next token. Once the input is exhausted it keeps returning the EndMark token,
+// and after an error it keeps returning the error
+func (s *Stream) Next() (*Token, error) {
+	token, err := s.fill()
+	if err != nil {
+		return nil, err
+	}
+	if token.Type != EndMark {
+		s.next++
+	}
+	s.trim()
+
+	return token, nil
+}
+
+// Peek returns the next token without consuming it
+func (s *Stream) Peek() (*Token, error) {
+	return s.fill()
+}
+
+// Mark returns a mark for the current position of the stream. Tokens from the mark onwards are
+// retained until the mark is released, so Reset can go back to it
+func (s *Stream) Mark() int {
+	s.marks = append(s.marks, s.next)
+
+	return s.next
+}
+
+// Reset goes back to a mark taken with Mark, the mark stays active
+func (s *Stream) Reset(mark int) {
+	if mark < s.base || mark > s.next {
+		panic("lexer: reset to a mark that isn't retained")
+	}
+
+	s.next = mark
+}
+
+// Release releases a mark, the tokens it was holding are dropped once no other mark needs them
+func (s *Stream) Release(mark int) {
+	for i := len(s.marks) - 1; i >= 0; i-- {
+		if s.marks[i] == mark {
+			s.marks = append(s.marks[:i], s.marks[i+1:]...)
+			break
+		}
+	}
+
+	s.trim()
+}
+
+// Close stops the lexing goroutine and waits for it to finish
+func (s *Stream) Close() {
+	s.cancel()
+	for range s.items {
+	}
+}
+
+// fill makes sure the token at s.next was received and returns it
+func (s *Stream) fill() (*Token, error) {
+	for s.next-s.base >= len(s.window) {
+		if s.err != nil {
+			return nil, s.err
+		}
+
+		item, ok := <-s.items
+		switch {
+		case !ok:
+			// The goroutine only gives up without saying why when it was cancelled
+			s.err = s.ctx.Err()
+			if s.err == nil {
+				s.err = io.ErrUnexpectedEOF
+			}
+		case item.err != nil:
+			s.err = item.err
+		default:
+			s.window = append(s.window, item.token)
+		}
+	}
+
+	return s.window[s.next-s.base], nil
+}
+
+// trim drops the tokens that were consumed and aren't held by any mark.
+// The last token is kept when it's the EndMark, so Next keeps returning it
+func (s *Stream) trim() {
+	keep := s.next
+	for _, mark := range s.marks {
+		keep = min(keep, mark)
+	}
+	if n := len(s.window); n > 0 && s.window[n-1].Type == EndMark {
+		keep = min(keep, s.base+n-1)
+	}
+
+	drop := keep - s.base
+	if drop <= 0 {
+		return
+	}
+
+	n := copy(s.window, s.window[drop:])
+	clear(s.window[n:])
+	s.window = s.window[:n]
+	s.base = keep
+}
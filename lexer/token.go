@@ -2,24 +2,64 @@ package lexer
 
 import "fmt"
 
+// Position is a location in the source, lines and columns start at 1. Columns are counted in the
+// ColumnUnit of Options.Columns, runes by default
+type Position struct {
+	Offset int
+	Line   uint
+	Column uint
+	// Pos is the position in the FileSet of the source, NoPos if the lexer wasn't given a File
+	Pos Pos
+}
+
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Position) String() string {
+	if !p.IsValid() {
+		return "-"
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Token is a lexeme and the range of the source it was read from.
+// Start is the position of the first character, End the position right after the last one,
+// so delimiters like quotes and angle brackets are included in the range but not in the lexeme.
+// Raw is the source text of the range as it was written, before escape sequences were decoded
 type Token struct {
 	Lexeme string
+	Raw    string
 	Type   TokenType
-	Line   uint
-	Column uint
+	Start  Position
+	End    Position
+	// Set is the parsed content of a CharClass token, nil for every other type
+	Set *CharSet
+	// Trivia is the source text between tokens: whitespace, comments when the lexer keeps them as
+	// trivia, and the braces and commas of actions, which have no tokens of their own.
+	// The trailing trivia of a token runs up to the end of its line, the next token gets the rest
+	// as its leading trivia, so concatenating the Text of every token, EndMark included,
+	// reproduces the input. TrailingTrivia is only known once the next token has been lexed
+	LeadingTrivia  string
+	TrailingTrivia string
 }
 
-func NewToken(lexeme string, line, column uint, typ TokenType) *Token {
+func NewToken(lexeme string, start, end Position, typ TokenType) *Token {
 	return &Token{
 		Lexeme: lexeme,
 		Type:   typ,
-		Line:   line,
-		Column: column,
+		Start:  start,
+		End:    end,
 	}
 }
 
 func (t *Token) String() string {
-	return fmt.Sprintf("[%s:%s:%d:%d]", t.Lexeme, t.Type, t.Line, t.Column)
+	return fmt.Sprintf("[%s:%s:%d:%d]", t.Lexeme, t.Type, t.Start.Line, t.Start.Column)
+}
+
+// Text returns the source text of the token with its trivia
+func (t *Token) Text() string {
+	return t.LeadingTrivia + t.Raw + t.TrailingTrivia
 }
 
 func (t *Token) TokenType() TokenType {
@@ -50,6 +90,30 @@ const (
 	EndMark
 	EndOfRule
 	Not
+	// Invalid is text the lexer skipped over while recovering from an error
+	Invalid
+	// Comment is a line or block comment, delimiters included in the lexeme
+	Comment
+	// CharClass is a character class like [a-z], its content is parsed into Token.Set
+	CharClass
+	// Postfix repetition operators, *, +, ? and {m,n}
+	ZeroOrMore
+	OneOrMore
+	ZeroOrOne
+	Repeat
+	// Arguments of a semantic action, see lexAction
+	ActionString
+	ActionNumber
+	ActionList
+	ActionListEnd
+	ActionCallEnd
+	// CodeBlock is raw host-language code between {{ and }}, the lexeme is the code without the braces
+	CodeBlock
+	// Extend is the operator adding alternatives to a rule, "|=" by default, see Dialect.Extend
+	Extend
+	// Braces of a repeated group, see Dialect.BraceRepetition
+	BraceLeft
+	BraceRight
 )
 
 func (t TokenType) String() string {
@@ -88,6 +152,38 @@ func (t TokenType) String() string {
 		return "EndOfRule"
 	case Not:
 		return "Not"
+	case Invalid:
+		return "Invalid"
+	case Comment:
+		return "Comment"
+	case CharClass:
+		return "CharClass"
+	case ZeroOrMore:
+		return "ZeroOrMore"
+	case OneOrMore:
+		return "OneOrMore"
+	case ZeroOrOne:
+		return "ZeroOrOne"
+	case Repeat:
+		return "Repeat"
+	case ActionString:
+		return "ActionString"
+	case ActionNumber:
+		return "ActionNumber"
+	case ActionList:
+		return "ActionList"
+	case ActionListEnd:
+		return "ActionListEnd"
+	case ActionCallEnd:
+		return "ActionCallEnd"
+	case CodeBlock:
+		return "CodeBlock"
+	case Extend:
+		return "Extend"
+	case BraceLeft:
+		return "BraceLeft"
+	case BraceRight:
+		return "BraceRight"
 	default:
 		return "Unknown"
 	}
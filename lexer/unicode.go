@@ -0,0 +1,70 @@
+package lexer
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// ColumnUnit is what columns are counted in. Editors and protocols disagree, LSP counts
+// UTF-16 code units for instance, so the lexer counts in the unit the tooling wants
+type ColumnUnit uint
+
+const (
+	ColumnRunes ColumnUnit = iota
+	ColumnBytes
+	ColumnUTF16
+)
+
+func (u ColumnUnit) String() string {
+	switch u {
+	case ColumnRunes:
+		return "runes"
+	case ColumnBytes:
+		return "bytes"
+	case ColumnUTF16:
+		return "utf-16"
+	default:
+		return "unknown"
+	}
+}
+
+// width returns the number of columns taken by r, encoded in size bytes
+func (u ColumnUnit) width(r rune, size int) uint {
+	switch u {
+	case ColumnBytes:
+		return uint(size)
+	case ColumnUTF16:
+		return uint(utf16Len(r))
+	default:
+		return 1
+	}
+}
+
+func utf16Len(r rune) int {
+	if r >= 0x10000 && r <= utf8.MaxRune {
+		return 2
+	}
+	return 1
+}
+
+// bom is the byte order mark. At the very start of the input it's trivia taking no column,
+// anywhere else it's a zero width no-break space
+const bom = '\uFEFF'
+
+// isSpace reports whether r has the Unicode White_Space property
+func isSpace(r rune) bool {
+	if r < utf8.RuneSelf {
+		return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\v' || r == '\f'
+	}
+	return unicode.Is(unicode.White_Space, r)
+}
+
+// isIdentifier tells which tokens are names, the ones Lexer.Normalize applies to
+func isIdentifier(typ TokenType) bool {
+	switch typ {
+	case NonTerminalSymbol, Action, ActionArg:
+		return true
+	}
+
+	return false
+}
@@ -1,4 +1,144 @@
+// Command gbnf works with grammar files.
+//
+// Usage:
+//
+//	gbnf fmt [-d] [-w] [-dialect name] [path ...]
+//
+// fmt formats grammars in the canonical layout of package format. Without paths it formats
+// the standard input to the standard output
 package main
 
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"gbnf/format"
+	"gbnf/lexer"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+var dialects = map[string]*lexer.Dialect{}
+
+func init() {
+	for _, d := range []*lexer.Dialect{lexer.Default, lexer.BNF, lexer.EBNF, lexer.PEG, lexer.GBNF} {
+		dialects[d.Name] = d
+	}
+}
+
 func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "fmt":
+		os.Exit(runFmt(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	case "help", "-h", "-help", "--help":
+		usage(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "gbnf: unknown command %q\n", os.Args[1])
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: gbnf fmt [-d] [-w] [-dialect name] [path ...]")
+}
+
+// runFmt runs the fmt command and returns the exit code: 0 on success, 1 if a file couldn't be
+// formatted and 2 for a bad command line
+func runFmt(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	diff := flags.Bool("d", false, "print diffs instead of the formatted grammars")
+	write := flags.Bool("w", false, "write the formatted grammars back to their files")
+	name := flags.String("dialect", lexer.Default.Name, "dialect of the grammars: "+dialectNames())
+	flags.Usage = func() {
+		usage(stderr)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	dialect, ok := dialects[*name]
+	if !ok {
+		fmt.Fprintf(stderr, "gbnf fmt: unknown dialect %q, expected one of %s\n", *name, dialectNames())
+		return 2
+	}
+
+	if flags.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(stderr, "gbnf fmt: can't use -w on the standard input")
+			return 2
+		}
+		src, err := io.ReadAll(stdin)
+		if err == nil {
+			err = formatFile("<standard input>", src, dialect, *diff, false, stdout)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	code := 0
+	for _, path := range flags.Args() {
+		src, err := os.ReadFile(path)
+		if err == nil {
+			err = formatFile(path, src, dialect, *diff, *write, stdout)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			code = 1
+		}
+	}
+
+	return code
+}
+
+// formatFile formats src, read from path, and writes the result to out, or the diff with the
+// source if diff is set. With write the result replaces the file instead, only if it changed
+func formatFile(path string, src []byte, d *lexer.Dialect, diff, write bool, out io.Writer) error {
+	res, err := format.Source(src, lexer.Options{Dialect: d, Filename: path})
+	if err != nil {
+		return err
+	}
+
+	if diff {
+		if _, err := out.Write(unifiedDiff(path+".orig", path, src, res)); err != nil {
+			return err
+		}
+	}
+	if write {
+		if bytes.Equal(src, res) {
+			return nil
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, res, info.Mode().Perm())
+	}
+	if !diff {
+		_, err = out.Write(res)
+	}
+
+	return err
+}
+
+func dialectNames() string {
+	names := make([]string, 0, len(dialects))
+	for name := range dialects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
 }
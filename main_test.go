@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Testing if the diff has a hunk per group of changes, with their context
+func TestUnifiedDiff(t *testing.T) {
+	a := []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12")
+	b := []byte("1\ntwo\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n")
+
+	expected := "--- a\n+++ b\n" +
+		"@@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n" +
+		"@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n\\ No newline at end of file\n+12\n"
+	if diff := string(unifiedDiff("a", "b", a, b)); diff != expected {
+		t.Fatalf("Expected\n%s\ngot\n%s", expected, diff)
+	}
+
+	if diff := unifiedDiff("a", "b", a, a); len(diff) != 0 {
+		t.Fatalf("Expected no diff, got\n%s", diff)
+	}
+}
+
+// Testing if fmt -d prints a diff and fmt -w rewrites the file
+func TestRunFmt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "g.gbnf")
+	if err := os.WriteFile(path, []byte("<a>::=x|y\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := runFmt([]string{"-d", path}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected 0, got %d: %s", code, stderr.String())
+	}
+	expected := "--- " + path + ".orig\n+++ " + path + "\n@@ -1,1 +1,2 @@\n-<a>::=x|y\n+<a> ::= \"x\"\n+      | \"y\"\n"
+	if stdout.String() != expected {
+		t.Fatalf("Expected\n%s\ngot\n%s", expected, stdout.String())
+	}
+
+	if code := runFmt([]string{"-w", path}, nil, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected 0, got %d: %s", code, stderr.String())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "<a> ::= \"x\"\n      | \"y\"\n" {
+		t.Fatalf("Expected the file to be formatted, got\n%s", data)
+	}
+
+	if code := runFmt([]string{"-dialect", "nope"}, nil, &stdout, &stderr); code != 2 {
+		t.Fatalf("Expected 2, got %d", code)
+	}
+}
@@ -1 +1,524 @@
-package main
+package parser
+
+import (
+	"errors"
+	"gbnf/ast"
+	"gbnf/lexer"
+)
+
+// Parse parses production rules until the end of the input
+//
+//	grammar  ::= rule*
+//	rule     ::= NonTerminalSymbol ("::=" | "|=") alts "!!"?
+//	alts     ::= sequence ("|" sequence)*
+//	sequence ::= item*
+//	item     ::= action | CodeBlock | ("!" | "&")? postfix
+//	postfix  ::= (primary | TerminalSymbol "..." TerminalSymbol) ("*" | "+" | "?" | "{m,n}")*
+//	primary  ::= CharClass | symbol ("=" primary)? | "(" alts ")" | "[" alts "]" | "{" alts "}"
+//	symbol   ::= TerminalSymbol | NonTerminalSymbol
+//	action   ::= Action arg* ActionCallEnd
+//	arg      ::= action | ActionArg | ActionString | ActionNumber | ActionList arg* ActionListEnd
+//
+// When the lexer was built with Options.Recover, a broken rule doesn't stop the parse: the error is
+// recorded, the parser skips to the next rule and the tree gets a placeholder for what it skipped.
+// The tree is then returned along with an ErrorList of every error, lexical ones included.
+// The rules of the tree are indexed, a name defined twice or extended before it's defined is an error
+func (p *Parser) Parse() (*ast.AST, error) {
+	tree, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.index(tree); err != nil {
+		return nil, err
+	}
+
+	return tree, p.Err()
+}
+
+// parse parses the rules without indexing them, errors recovered from are left in p.Errors
+func (p *Parser) parse() (*ast.AST, error) {
+	tree := &ast.AST{Root: make([]ast.Node, 0)}
+
+	for {
+		token, err := p.peek()
+		if err != nil {
+			return nil, p.locate(err)
+		}
+		if token.Type == lexer.EndMark {
+			tree.Comments = p.comments
+			return tree, nil
+		}
+
+		last := p.last
+		rule, err := p.parseProdRule()
+		if err != nil {
+			var perr *Error
+			if !p.lexer.Recover || !errors.As(err, &perr) {
+				return nil, p.locate(err)
+			}
+			node, err := p.recover(token, last, rule, perr)
+			if err != nil {
+				return nil, p.locate(err)
+			}
+			tree.Root = append(tree.Root, node)
+			continue
+		}
+		tree.Root = append(tree.Root, rule)
+	}
+}
+
+// index builds the rule table of the tree, the errors are recorded in recovery mode
+func (p *Parser) index(tree *ast.AST) error {
+	for _, err := range tree.Index() {
+		err.Filename = p.lexer.Filename
+		if err.Prev != nil {
+			err.PrevFilename = p.lexer.Filename
+		}
+		if !p.lexer.Recover {
+			return err
+		}
+		p.Errors = append(p.Errors, err)
+	}
+
+	return nil
+}
+
+// parseProdRule parses a rule. When the error is on the right side of the rule, the rule is
+// returned along with the error, with a BadExpr starting where the right side does
+func (p *Parser) parseProdRule() (*ast.ProdRule, error) {
+	left, err := p.expect(lexer.NonTerminalSymbol)
+	if err != nil {
+		return nil, err
+	}
+	define, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if define.Type != lexer.Extend {
+		define, err = p.expect(lexer.ProdRule)
+	} else {
+		_, err = p.next()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	rule := &ast.ProdRule{Left: left, Define: define, Right: &ast.BadExpr{From: first.Start}}
+
+	right, err := p.parseAlternatives()
+	if err != nil {
+		return rule, err
+	}
+
+	token, err := p.peek()
+	if err != nil {
+		return rule, err
+	}
+	switch token.Type {
+	case lexer.EndOfRule:
+		if _, err := p.next(); err != nil {
+			return rule, err
+		}
+		rule.EndOfRule = token
+	case lexer.NonTerminalSymbol, lexer.EndMark:
+	default:
+		return rule, unexpected(token, "end of rule")
+	}
+	rule.Right = right
+
+	return rule, nil
+}
+
+// recover records err and skips to the next rule, past a terminator ending the broken rule or up
+// to a non-terminal followed by "::=" or "|=". start is the first token of the broken rule and last the
+// token before it. A rule whose name and "::=" were read is kept with a BadExpr on its right
+// side, otherwise the skipped tokens are replaced with a BadRule
+func (p *Parser) recover(start, last *lexer.Token, rule *ast.ProdRule, err *Error) (ast.Node, error) {
+	// The lexer already reported the text it couldn't read
+	if err.Token == nil || err.Token.Type != lexer.Invalid {
+		p.Errors = append(p.Errors, p.locate(err))
+	}
+
+	// Make sure the parser moves forward even when the error is right at a synchronization point
+	if p.last == last {
+		if _, err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	to := p.last.End
+	var terminator *lexer.Token
+loop:
+	for {
+		token, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+
+		switch token.Type {
+		case lexer.EndMark:
+			break loop
+		case lexer.NonTerminalSymbol:
+			next, err := p.peekN(1)
+			if err != nil {
+				return nil, err
+			}
+			if startsRule(next) {
+				break loop
+			}
+		case lexer.EndOfRule:
+			if terminator, err = p.next(); err != nil {
+				return nil, err
+			}
+			break loop
+		}
+
+		if _, err := p.next(); err != nil {
+			return nil, err
+		}
+		to = token.End
+	}
+
+	if rule == nil {
+		if terminator != nil {
+			to = terminator.End
+		}
+		return &ast.BadRule{From: start.Start, To: to}, nil
+	}
+
+	bad := rule.Right.(*ast.BadExpr)
+	bad.To = to
+	if bad.To.Offset < bad.From.Offset {
+		bad.To = bad.From
+	}
+	rule.EndOfRule = terminator
+
+	return rule, nil
+}
+
+func (p *Parser) parseAlternatives() (ast.Expr, error) {
+	alts := make([]ast.Expr, 0)
+	ors := make([]*lexer.Token, 0)
+
+	for {
+		seq, err := p.parseSequence()
+		if err != nil {
+			return nil, err
+		}
+		alts = append(alts, seq)
+
+		token, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if token.Type != lexer.Or {
+			break
+		}
+		if _, err := p.next(); err != nil {
+			return nil, err
+		}
+		ors = append(ors, token)
+	}
+
+	if len(alts) == 1 {
+		return alts[0], nil
+	}
+
+	return &ast.Alternation{Alternatives: alts, Ors: ors}, nil
+}
+
+func (p *Parser) parseSequence() (ast.Expr, error) {
+	items := make([]ast.Expr, 0)
+
+	for {
+		end, err := p.atSequenceEnd()
+		if err != nil {
+			return nil, err
+		}
+		if end {
+			break
+		}
+
+		item, err := p.parseItem()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	if len(items) == 1 {
+		return items[0], nil
+	}
+
+	return &ast.Sequence{Items: items}, nil
+}
+
+// atSequenceEnd reports whether the next token can't continue the current sequence.
+// A non-terminal followed by "::=" starts the next rule, so it needs two tokens of lookahead
+func (p *Parser) atSequenceEnd() (bool, error) {
+	token, err := p.peek()
+	if err != nil {
+		return false, err
+	}
+
+	switch token.Type {
+	case lexer.Or, lexer.ParenRight, lexer.BracketRight, lexer.BraceRight, lexer.EndOfRule, lexer.EndMark:
+		return true, nil
+	case lexer.NonTerminalSymbol:
+		next, err := p.peekN(1)
+		if err != nil {
+			return false, err
+		}
+		return startsRule(next), nil
+	}
+
+	return false, nil
+}
+
+// startsRule reports whether a non-terminal followed by token is the start of a rule
+func startsRule(token *lexer.Token) bool {
+	return token.Type == lexer.ProdRule || token.Type == lexer.Extend
+}
+
+func (p *Parser) parseItem() (ast.Expr, error) {
+	token, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token.Type {
+	case lexer.Action:
+		return p.parseAction()
+	case lexer.CodeBlock:
+		if _, err := p.next(); err != nil {
+			return nil, err
+		}
+		return &ast.CodeBlock{Token: token}, nil
+	case lexer.Not, lexer.And:
+		if _, err := p.next(); err != nil {
+			return nil, err
+		}
+		expr, err := p.parsePostfix()
+		if err != nil {
+			return nil, err
+		}
+		if token.Type == lexer.Not {
+			return &ast.NotPredicate{Not: token, Expr: expr}, nil
+		}
+		return &ast.AndPredicate{And: token, Expr: expr}, nil
+	}
+
+	return p.parsePostfix()
+}
+
+func (p *Parser) parsePostfix() (ast.Expr, error) {
+	expr, err := p.parseRange()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+
+		rep := &ast.Repetition{Expr: expr, Op: op}
+		switch op.Type {
+		case lexer.ZeroOrMore:
+			rep.Min, rep.Max = 0, -1
+		case lexer.OneOrMore:
+			rep.Min, rep.Max = 1, -1
+		case lexer.ZeroOrOne:
+			rep.Min, rep.Max = 0, 1
+		case lexer.Repeat:
+			if rep.Min, rep.Max, err = lexer.RepeatBounds(op); err != nil {
+				return nil, &Error{Err: err, Token: op, Line: op.Start.Line, Column: op.Start.Column}
+			}
+		default:
+			return expr, nil
+		}
+		if _, err := p.next(); err != nil {
+			return nil, err
+		}
+		expr = rep
+	}
+}
+
+func (p *Parser) parseRange() (ast.Expr, error) {
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	op, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if op.Type != lexer.Sequence {
+		return expr, nil
+	}
+
+	from, ok := expr.(*ast.Literal)
+	if !ok {
+		return nil, unexpected(op, "terminal symbol before range")
+	}
+	if _, err := p.next(); err != nil {
+		return nil, err
+	}
+	to, err := p.expect(lexer.TerminalSymbol)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ast.Range{From: from, Op: op, To: &ast.Literal{Token: to}}, nil
+}
+
+func (p *Parser) parsePrimary() (ast.Expr, error) {
+	token, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token.Type {
+	case lexer.CharClass:
+		return &ast.CharClass{Token: token}, nil
+	case lexer.NonTerminalSymbol, lexer.TerminalSymbol:
+		next, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if next.Type != lexer.Assign {
+			if token.Type == lexer.NonTerminalSymbol {
+				return &ast.NonTerminalRef{Name: token}, nil
+			}
+			return &ast.Literal{Token: token}, nil
+		}
+		// Labeled element, x=<expr>. Dialects with bare non-terminals write the label the same way
+		if _, err := p.next(); err != nil {
+			return nil, err
+		}
+		expr, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return &ast.Labeled{Label: token, Assign: next, Expr: expr}, nil
+	case lexer.ParenLeft:
+		expr, err := p.parseAlternatives()
+		if err != nil {
+			return nil, err
+		}
+		right, err := p.expect(lexer.ParenRight)
+		if err != nil {
+			return nil, err
+		}
+		return &ast.Group{Lparen: token, Expr: expr, Rparen: right}, nil
+	case lexer.BracketLeft:
+		expr, err := p.parseAlternatives()
+		if err != nil {
+			return nil, err
+		}
+		right, err := p.expect(lexer.BracketRight)
+		if err != nil {
+			return nil, err
+		}
+		return &ast.Optional{Lbrack: token, Expr: expr, Rbrack: right}, nil
+	case lexer.BraceLeft:
+		// {x} is x repeated zero or more times, the group keeps the braces
+		expr, err := p.parseAlternatives()
+		if err != nil {
+			return nil, err
+		}
+		right, err := p.expect(lexer.BraceRight)
+		if err != nil {
+			return nil, err
+		}
+		group := &ast.Group{Lparen: token, Expr: expr, Rparen: right}
+		return &ast.Repetition{Expr: group, Min: 0, Max: -1, Op: right}, nil
+	}
+
+	return nil, unexpected(token, "symbol or group")
+}
+
+func (p *Parser) parseAction() (ast.Expr, error) {
+	action, err := p.parseActionCall()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ast.ActionCall{Action: action}, nil
+}
+
+func (p *Parser) parseActionCall() (*ast.Action, error) {
+	token, err := p.expect(lexer.Action)
+	if err != nil {
+		return nil, err
+	}
+
+	action := &ast.Action{
+		Action: token,
+		Args:   make([]ast.ActionArg, 0),
+	}
+
+	for {
+		token, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if token.Type == lexer.ActionCallEnd {
+			action.Rparen, err = p.next()
+			return action, err
+		}
+
+		arg, err := p.parseActionArg()
+		if err != nil {
+			return nil, err
+		}
+		action.Args = append(action.Args, arg)
+	}
+}
+
+func (p *Parser) parseActionArg() (ast.ActionArg, error) {
+	token, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token.Type {
+	case lexer.Action:
+		return p.parseActionCall()
+	case lexer.ActionArg:
+		_, err := p.next()
+		return &ast.ActionRef{Name: token}, err
+	case lexer.ActionString, lexer.ActionNumber:
+		_, err := p.next()
+		return &ast.ActionLiteral{Token: token}, err
+	case lexer.ActionList:
+		if _, err := p.next(); err != nil {
+			return nil, err
+		}
+		list := &ast.ActionList{Lbrack: token, Elems: make([]ast.ActionArg, 0)}
+		for {
+			next, err := p.peek()
+			if err != nil {
+				return nil, err
+			}
+			if next.Type == lexer.ActionListEnd {
+				list.Rbrack, err = p.next()
+				return list, err
+			}
+
+			elem, err := p.parseActionArg()
+			if err != nil {
+				return nil, err
+			}
+			list.Elems = append(list.Elems, elem)
+		}
+	}
+
+	return nil, unexpected(token, "action argument")
+}
@@ -1 +1,320 @@
 package parser
+
+import (
+	"errors"
+	"fmt"
+	"gbnf/ast"
+	"gbnf/lexer"
+	"io"
+	"os"
+	"sort"
+)
+
+// Parser consumes the token stream of a lexer.Lexer and builds an ast.AST
+type Parser struct {
+	lexer *lexer.Lexer
+	// Lookahead buffer, tokens are pulled from the lexer on demand
+	buf []*lexer.Token
+	eof *lexer.Token
+	// Last token consumed
+	last *lexer.Token
+	// Comments skipped so far
+	comments []*lexer.Token
+	// Errors found in recovery mode, see Parse
+	Errors ErrorList
+}
+
+func NewParser(r io.Reader) *Parser {
+	return NewParserWithOptions(r, lexer.Options{})
+}
+
+// NewParserWithOptions builds a parser on top of a lexer configured with opts, e.g. to read another dialect
+func NewParserWithOptions(r io.Reader, opts lexer.Options) *Parser {
+	return newParser(lexer.NewLexerWithOptions(r, opts))
+}
+
+// NewStringParser builds a parser over a grammar held in a string, see lexer.NewStringLexer
+func NewStringParser(src string, opts lexer.Options) *Parser {
+	return newParser(lexer.NewStringLexerWithOptions(src, opts))
+}
+
+func newParser(l *lexer.Lexer) *Parser {
+	return &Parser{
+		lexer: l,
+		buf:   make([]*lexer.Token, 0),
+	}
+}
+
+// Parse reads the whole grammar from r and parses it
+func Parse(r io.Reader) (*ast.AST, error) {
+	return ParseWithOptions(r, lexer.Options{})
+}
+
+func ParseWithOptions(r io.Reader, opts lexer.Options) (*ast.AST, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return newParser(lexer.NewBytesLexerWithOptions(data, opts)).Parse()
+}
+
+// ParseString parses a grammar held in a string, the tokens of the tree share its memory
+func ParseString(src string, opts lexer.Options) (*ast.AST, error) {
+	return NewStringParser(src, opts).Parse()
+}
+
+// ParseFile adds a file to fset and parses it, the positions of the tokens carry a lexer.Pos
+// in fset. The source is read from filename if src is nil, otherwise it's copied so the tree
+// doesn't change along with it
+func ParseFile(fset *lexer.FileSet, filename string, src []byte, opts lexer.Options) (*ast.AST, error) {
+	if src != nil {
+		opts.File = fset.AddFile(filename, -1, len(src))
+		return NewStringParser(string(src), opts).Parse()
+	}
+
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	opts.File = fset.AddFile(filename, -1, len(src))
+
+	return newParser(lexer.NewBytesLexerWithOptions(src, opts)).Parse()
+}
+
+// ParseFiles parses every file into a single tree, the rules are in the order of the files.
+// fset tells which file a rule comes from. The rules are indexed once every file is parsed, so a
+// file can extend the rules of the files before it. In recovery mode the errors of every file are returned
+func ParseFiles(fset *lexer.FileSet, filenames []string, opts lexer.Options) (*ast.AST, error) {
+	tree := &ast.AST{Root: make([]ast.Node, 0)}
+	var errs ErrorList
+	for _, filename := range filenames {
+		src, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		opts.File = fset.AddFile(filename, -1, len(src))
+
+		p := newParser(lexer.NewBytesLexerWithOptions(src, opts))
+		file, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		tree.Root = append(tree.Root, file.Root...)
+		tree.Comments = append(tree.Comments, file.Comments...)
+		if err, ok := p.Err().(ErrorList); ok {
+			errs = append(errs, err...)
+		}
+	}
+
+	for _, err := range tree.Index() {
+		err.Filename = fset.Position(err.Rule.Pos().Pos).Filename
+		if err.Prev != nil {
+			err.PrevFilename = fset.Position(err.Prev.Pos().Pos).Filename
+		}
+		if !opts.Recover {
+			return nil, err
+		}
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return tree, errs
+	}
+
+	return tree, nil
+}
+
+// fill makes sure there are at least n tokens in the lookahead buffer.
+// Once the lexer runs out of tokens the buffer is padded with an EndMark token
+func (p *Parser) fill(n int) error {
+	for len(p.buf) < n {
+		if p.eof != nil {
+			p.buf = append(p.buf, p.eof)
+			continue
+		}
+
+		token, err := p.lexer.NextToken()
+		if err != nil {
+			return err
+		}
+		if token == nil || token.Type == lexer.EndMark {
+			p.eof = p.endMark(token)
+			continue
+		}
+		if token.Type == lexer.Comment {
+			p.comments = append(p.comments, token)
+			continue
+		}
+
+		p.buf = append(p.buf, token)
+	}
+
+	return nil
+}
+
+// endMark returns the token used to signal the end of the input.
+// The lexer doesn't always emit an EndMark, so one is built from the last token seen
+func (p *Parser) endMark(token *lexer.Token) *lexer.Token {
+	if token != nil {
+		return token
+	}
+
+	var pos lexer.Position
+	if n := len(p.lexer.Tokens); n > 0 {
+		pos = p.lexer.Tokens[n-1].End
+	}
+
+	return lexer.NewToken("", pos, pos, lexer.EndMark)
+}
+
+func (p *Parser) peekN(n int) (*lexer.Token, error) {
+	if err := p.fill(n + 1); err != nil {
+		return nil, err
+	}
+
+	return p.buf[n], nil
+}
+
+func (p *Parser) peek() (*lexer.Token, error) {
+	return p.peekN(0)
+}
+
+func (p *Parser) next() (*lexer.Token, error) {
+	token, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	p.buf = p.buf[1:]
+	p.last = token
+
+	return token, nil
+}
+
+func (p *Parser) expect(typ lexer.TokenType) (*lexer.Token, error) {
+	token, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if token.Type != typ {
+		return nil, unexpected(token, typ.String())
+	}
+
+	return p.next()
+}
+
+type ErrParser string
+
+const (
+	ErrUnexpectedToken ErrParser = "unexpected token"
+	ErrUnexpectedEOF   ErrParser = "unexpected end of input"
+)
+
+func (e ErrParser) Error() string {
+	return string(e)
+}
+
+func (e ErrParser) String() string {
+	return string(e)
+}
+
+// Error is a parse error located at the offending token
+type Error struct {
+	Err      error
+	Token    *lexer.Token
+	Filename string
+	Line     uint
+	Column   uint
+	Expected string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Err)
+	if e.Filename != "" {
+		msg = e.Filename + ":" + msg
+	}
+	if e.Token != nil && e.Token.Type != lexer.EndMark {
+		msg += fmt.Sprintf(" %q (%s)", e.Token.Lexeme, e.Token.Type)
+	}
+	if e.Expected != "" {
+		msg += ", expected " + e.Expected
+	}
+
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorList is the list of errors found by a parse in recovery mode, lexical and parse errors
+// alike, in the order of the input
+type ErrorList []error
+
+func (e ErrorList) Error() string {
+	return lexer.SummarizeErrors(e)
+}
+
+func (e ErrorList) Unwrap() []error {
+	return e
+}
+
+// Err returns the errors found in recovery mode, the ones of the lexer included, or nil if there were none
+func (p *Parser) Err() error {
+	if len(p.Errors) == 0 && len(p.lexer.Errors) == 0 {
+		return nil
+	}
+
+	errs := make(ErrorList, 0, len(p.Errors)+len(p.lexer.Errors))
+	for _, err := range p.lexer.Errors {
+		errs = append(errs, err)
+	}
+	errs = append(errs, p.Errors...)
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errorOffset(errs[i]) < errorOffset(errs[j])
+	})
+
+	return errs
+}
+
+func errorOffset(err error) int {
+	var lerr *lexer.Error
+	if errors.As(err, &lerr) {
+		return lerr.Pos.Offset
+	}
+	var perr *Error
+	if errors.As(err, &perr) && perr.Token != nil {
+		return perr.Token.Start.Offset
+	}
+	var rerr *ast.RuleError
+	if errors.As(err, &rerr) {
+		return rerr.Rule.Pos().Offset
+	}
+
+	return 0
+}
+
+// locate fills in the file name of a parse error, which unexpected doesn't know
+func (p *Parser) locate(err error) error {
+	var perr *Error
+	if errors.As(err, &perr) && perr.Filename == "" {
+		perr.Filename = p.lexer.Filename
+	}
+
+	return err
+}
+
+func unexpected(token *lexer.Token, expected string) *Error {
+	err := ErrUnexpectedToken
+	if token.Type == lexer.EndMark {
+		err = ErrUnexpectedEOF
+	}
+
+	return &Error{
+		Err:      err,
+		Token:    token,
+		Line:     token.Start.Line,
+		Column:   token.Start.Column,
+		Expected: expected,
+	}
+}
@@ -1 +1,661 @@
 package parser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gbnf/ast"
+	"gbnf/lexer"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Testing if the parser builds one production rule per definition
+func TestParse_Rules(t *testing.T) {
+	buffer := []byte("<expr> ::= <term> \"+\" <expr> |  <term>\n<term> ::= NAME")
+
+	tree, err := Parse(bytes.NewReader(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tree.Root) != 2 {
+		t.Fatalf("Expected 2 rules, got %d", len(tree.Root))
+	}
+
+	rule, ok := tree.Root[0].(*ast.ProdRule)
+	if !ok {
+		t.Fatalf("Expected *ast.ProdRule, got %T", tree.Root[0])
+	}
+	if rule.Left.Lexeme != "expr" {
+		t.Fatalf("Expected expr, got %s", rule.Left.Lexeme)
+	}
+
+	alt, ok := rule.Right.(*ast.Alternation)
+	if !ok {
+		t.Fatalf("Expected *ast.Alternation, got %T", rule.Right)
+	}
+	if len(alt.Alternatives) != 2 {
+		t.Fatalf("Expected 2 alternatives, got %d", len(alt.Alternatives))
+	}
+	seq, ok := alt.Alternatives[0].(*ast.Sequence)
+	if !ok {
+		t.Fatalf("Expected *ast.Sequence, got %T", alt.Alternatives[0])
+	}
+	if len(seq.Items) != 3 {
+		t.Fatalf("Expected 3 items, got %d", len(seq.Items))
+	}
+	if _, ok := seq.Items[1].(*ast.Literal); !ok {
+		t.Fatalf("Expected *ast.Literal, got %T", seq.Items[1])
+	}
+	if _, ok := alt.Alternatives[1].(*ast.NonTerminalRef); !ok {
+		t.Fatalf("Expected *ast.NonTerminalRef, got %T", alt.Alternatives[1])
+	}
+
+	rule = tree.Root[1].(*ast.ProdRule)
+	if rule.Left.Lexeme != "term" {
+		t.Fatalf("Expected term, got %s", rule.Left.Lexeme)
+	}
+	lit, ok := rule.Right.(*ast.Literal)
+	if !ok || lit.Token.Lexeme != "NAME" {
+		t.Fatalf("Expected NAME, got %s", rule.Right)
+	}
+
+	t.Logf("AST: %s", tree.Root)
+}
+
+// Testing if the parser collects the actions of a rule
+func TestParse_Action(t *testing.T) {
+	buffer := []byte("<expr> ::= x=<expr> + y=<term> { Add(x, y) }\n\t| <term>\n<term> ::= NAME")
+
+	tree, err := Parse(bytes.NewReader(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule := tree.Root[0].(*ast.ProdRule)
+	seq := rule.Right.(*ast.Alternation).Alternatives[0].(*ast.Sequence)
+	if len(seq.Items) != 4 {
+		t.Fatalf("Expected 4 items, got %d", len(seq.Items))
+	}
+
+	labeled, ok := seq.Items[0].(*ast.Labeled)
+	if !ok {
+		t.Fatalf("Expected *ast.Labeled, got %T", seq.Items[0])
+	}
+	if labeled.Label.Lexeme != "x" {
+		t.Fatalf("Expected x, got %s", labeled.Label.Lexeme)
+	}
+
+	call, ok := seq.Items[3].(*ast.ActionCall)
+	if !ok {
+		t.Fatalf("Expected *ast.ActionCall, got %T", seq.Items[3])
+	}
+
+	action := call.Action
+	if action.Action.Lexeme != "Add" {
+		t.Fatalf("Expected Add, got %s", action.Action.Lexeme)
+	}
+	if len(action.Args) != 2 || action.Args[0].String() != "x" || action.Args[1].String() != "y" {
+		t.Fatalf("Expected [x y], got %s", action.Args)
+	}
+
+	t.Logf("AST: %s", tree.Root)
+}
+
+// Testing if the parser handles groups, predicates and the end of rule mark
+func TestParse_GroupsAndNot(t *testing.T) {
+	buffer := []byte("<expr> ::= !(<term> & \"+\" & <expr>) |  [<term> & + & \"test\"]!!\n<term> ::= \"a\" ... \"z\"!!")
+
+	tree, err := Parse(bytes.NewReader(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tree.Root) != 2 {
+		t.Fatalf("Expected 2 rules, got %d", len(tree.Root))
+	}
+
+	alt := tree.Root[0].(*ast.ProdRule).Right.(*ast.Alternation)
+	not, ok := alt.Alternatives[0].(*ast.NotPredicate)
+	if !ok {
+		t.Fatalf("Expected *ast.NotPredicate, got %T", alt.Alternatives[0])
+	}
+	if _, ok := not.Expr.(*ast.Group); !ok {
+		t.Fatalf("Expected *ast.Group, got %T", not.Expr)
+	}
+	if _, ok := alt.Alternatives[1].(*ast.Optional); !ok {
+		t.Fatalf("Expected *ast.Optional, got %T", alt.Alternatives[1])
+	}
+	if _, ok := tree.Root[1].(*ast.ProdRule).Right.(*ast.Range); !ok {
+		t.Fatalf("Expected *ast.Range, got %T", tree.Root[1].(*ast.ProdRule).Right)
+	}
+
+	expected := `<expr> ::= !(<term> &"+" &<expr>) | [<term> &"+" &"test"]`
+	if tree.Root[0].String() != expected {
+		t.Fatalf("Expected %s, got %s", expected, tree.Root[0])
+	}
+
+	t.Logf("AST: %s", tree.Root)
+}
+
+func TestParse_CommonLispBNF(t *testing.T) {
+	buffer := []byte(`
+<s_expression> ::= <atomic_symbol>
+	| "(" <s_expression> "."<s_expression> ")"
+	| <list>
+<list> ::= "(" <s_expression> "<" <s_expression> ">" ")"
+<atomic_symbol> ::= <letter> <atom_part>
+<atom_part> ::= <empty> | <letter> <atom_part> | <number> <atom_part>
+<letter> ::= "a" ... "z"
+<number> ::= "1" ... "9"
+<empty> ::= " "`)
+
+	tree, err := Parse(bytes.NewReader(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tree.Root) != 7 {
+		t.Fatalf("Expected 7 rules, got %d", len(tree.Root))
+	}
+}
+
+// Testing if every grammar of testdata, the dialect being the extension of the file, is parsed
+func TestParse_Corpus(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("Expected grammars in testdata")
+	}
+
+	dialects := map[string]*lexer.Dialect{}
+	for _, d := range []*lexer.Dialect{lexer.Default, lexer.BNF, lexer.EBNF, lexer.PEG, lexer.GBNF} {
+		dialects["."+d.Name] = d
+	}
+	for _, path := range paths {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := ParseString(string(src), lexer.Options{Dialect: dialects[filepath.Ext(path)], Filename: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tree.Root) == 0 {
+			t.Fatalf("Expected rules in %s", path)
+		}
+	}
+}
+
+// Testing if parse errors point at the offending token
+func TestParse_Error(t *testing.T) {
+	buffer := []byte("<expr> ::= <term>\n| ::= <term>")
+
+	_, err := Parse(bytes.NewReader(buffer))
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if !errors.Is(err, ErrUnexpectedToken) {
+		t.Fatalf("Expected ErrUnexpectedToken, got %v", err)
+	}
+
+	var perr *Error
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected *Error, got %T", err)
+	}
+	if perr.Token.Type != lexer.ProdRule {
+		t.Fatalf("Expected ProdRule, got %s", perr.Token.Type)
+	}
+	if perr.Line != 2 || perr.Column != 3 {
+		t.Fatalf("Expected 2:3, got %d:%d", perr.Line, perr.Column)
+	}
+
+	t.Logf("Error: %s", err)
+}
+
+// Testing if a rule cut short by the end of the input is reported
+func TestParse_UnexpectedEOF(t *testing.T) {
+	buffer := []byte("<expr> ::= x=")
+
+	_, err := Parse(bytes.NewReader(buffer))
+	if !errors.Is(err, ErrUnexpectedEOF) {
+		t.Fatalf("Expected ErrUnexpectedEOF, got %v", err)
+	}
+
+	t.Logf("Error: %s", err)
+}
+
+// Testing if the nodes span the source text they were parsed from
+func TestParse_Positions(t *testing.T) {
+	buffer := []byte("<expr> ::= x=<term>\n\t| !(\"a\" ... \"z\")!!")
+
+	tree, err := Parse(bytes.NewReader(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule := tree.Root[0].(*ast.ProdRule)
+	if rule.Pos().Offset != 0 || rule.End().Offset != len(buffer) {
+		t.Fatalf("Expected 0-%d, got %d-%d", len(buffer), rule.Pos().Offset, rule.End().Offset)
+	}
+
+	alt := rule.Right.(*ast.Alternation)
+	labeled := alt.Alternatives[0]
+	if text := string(buffer[labeled.Pos().Offset:labeled.End().Offset]); text != "x=<term>" {
+		t.Fatalf("Expected x=<term>, got %s", text)
+	}
+
+	not := alt.Alternatives[1].(*ast.NotPredicate)
+	if not.Pos().Line != 2 || not.Pos().Column != 4 {
+		t.Fatalf("Expected 2:4, got %s", not.Pos())
+	}
+	if text := string(buffer[not.Pos().Offset:not.End().Offset]); text != "!(\"a\" ... \"z\")" {
+		t.Fatalf("Expected !(\"a\" ... \"z\"), got %s", text)
+	}
+}
+
+// Testing if comments are skipped by the parser
+func TestParse_Comments(t *testing.T) {
+	buffer := []byte("# numbers\n<digit> ::= \"0\" ... \"9\" ; a single digit\n(* one or more *)\n<number> ::= <digit> | <digit> <number>")
+
+	tree, err := Parse(bytes.NewReader(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tree.Root) != 2 {
+		t.Fatalf("Expected 2 rules, got %d", len(tree.Root))
+	}
+
+	expected := "<number> ::= <digit> | <digit> <number>"
+	if tree.Root[1].String() != expected {
+		t.Fatalf("Expected %s, got %s", expected, tree.Root[1])
+	}
+}
+
+// Testing if character classes end up as CharClass nodes
+func TestParse_CharClass(t *testing.T) {
+	buffer := []byte(`<ident> ::= [a-zA-Z_] <rest> | ![^"0-9] <rest>`)
+
+	tree, err := Parse(bytes.NewReader(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alt := tree.Root[0].(*ast.ProdRule).Right.(*ast.Alternation)
+	class, ok := alt.Alternatives[0].(*ast.Sequence).Items[0].(*ast.CharClass)
+	if !ok {
+		t.Fatalf("Expected *ast.CharClass, got %T", alt.Alternatives[0].(*ast.Sequence).Items[0])
+	}
+	if !class.Token.Set.Contains('Q') {
+		t.Fatalf("Expected %s to contain Q", class)
+	}
+
+	expected := `<ident> ::= [a-zA-Z_] <rest> | ![^"0-9] <rest>`
+	if tree.Root[0].String() != expected {
+		t.Fatalf("Expected %s, got %s", expected, tree.Root[0])
+	}
+}
+
+// Testing if postfix operators build Repetition nodes
+func TestParse_Repetition(t *testing.T) {
+	buffer := []byte(`<list> ::= <item> ("," <item>)* ","? !<end>+ "a"..."z"{1,8} <x>{3,}`)
+
+	tree, err := Parse(bytes.NewReader(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seq := tree.Root[0].(*ast.ProdRule).Right.(*ast.Sequence)
+	if len(seq.Items) != 6 {
+		t.Fatalf("Expected 6 items, got %d", len(seq.Items))
+	}
+
+	rep, ok := seq.Items[1].(*ast.Repetition)
+	if !ok {
+		t.Fatalf("Expected *ast.Repetition, got %T", seq.Items[1])
+	}
+	if rep.Min != 0 || rep.Max != -1 {
+		t.Fatalf("Expected 0,-1, got %d,%d", rep.Min, rep.Max)
+	}
+	if _, ok := rep.Expr.(*ast.Group); !ok {
+		t.Fatalf("Expected *ast.Group, got %T", rep.Expr)
+	}
+
+	not, ok := seq.Items[3].(*ast.NotPredicate)
+	if !ok {
+		t.Fatalf("Expected *ast.NotPredicate, got %T", seq.Items[3])
+	}
+	if _, ok := not.Expr.(*ast.Repetition); !ok {
+		t.Fatalf("Expected *ast.Repetition, got %T", not.Expr)
+	}
+
+	rep = seq.Items[4].(*ast.Repetition)
+	if _, ok := rep.Expr.(*ast.Range); !ok || rep.Min != 1 || rep.Max != 8 {
+		t.Fatalf("Expected a range repeated 1 to 8 times, got %s", rep)
+	}
+
+	expected := `<list> ::= <item> ("," <item>)* ","? !<end>+ "a" ... "z"{1,8} <x>{3,}`
+	if tree.Root[0].String() != expected {
+		t.Fatalf("Expected %s, got %s", expected, tree.Root[0])
+	}
+}
+
+// Testing if grammars written in other dialects are parsed into the same nodes
+func TestParse_Dialects(t *testing.T) {
+	tests := []struct {
+		dialect *lexer.Dialect
+		input   string
+	}{
+		{lexer.GBNF, "root ::= item (\",\" item)*\nitem ::= [a-z]+ | \"null\""},
+		{lexer.PEG, "root <- item (\",\" item)*\nitem <- [a-z]+ / \"null\""},
+		{lexer.EBNF, "root = item, [\",\", root] ;\nitem : \"a\" | \"null\" ;"},
+	}
+
+	for _, test := range tests {
+		tree, err := ParseWithOptions(bytes.NewReader([]byte(test.input)), lexer.Options{Dialect: test.dialect})
+		if err != nil {
+			t.Fatalf("%s: %s", test.dialect.Name, err)
+		}
+		if len(tree.Root) != 2 {
+			t.Fatalf("%s: expected 2 rules, got %d", test.dialect.Name, len(tree.Root))
+		}
+
+		rule := tree.Root[0].(*ast.ProdRule)
+		if rule.Left.Lexeme != "root" {
+			t.Fatalf("%s: expected root, got %s", test.dialect.Name, rule.Left.Lexeme)
+		}
+		seq := rule.Right.(*ast.Sequence)
+		if _, ok := seq.Items[0].(*ast.NonTerminalRef); !ok {
+			t.Fatalf("%s: expected *ast.NonTerminalRef, got %T", test.dialect.Name, seq.Items[0])
+		}
+		if _, ok := tree.Root[1].(*ast.ProdRule).Right.(*ast.Alternation); !ok {
+			t.Fatalf("%s: expected *ast.Alternation, got %T", test.dialect.Name, tree.Root[1].(*ast.ProdRule).Right)
+		}
+	}
+}
+
+// Testing if EBNF braces are parsed as a group repeated zero or more times
+func TestParse_EBNFRepetition(t *testing.T) {
+	tree, err := ParseString("expr = term, { \"+\", term } ;", lexer.Options{Dialect: lexer.EBNF})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seq := tree.Root[0].(*ast.ProdRule).Right.(*ast.Sequence)
+	rep, ok := seq.Items[1].(*ast.Repetition)
+	if !ok || rep.Min != 0 || rep.Max != -1 || rep.Braced() == nil {
+		t.Fatalf("Expected a braced *ast.Repetition, got %T", seq.Items[1])
+	}
+	if rep.Pos().Column != 14 || rep.End().Column != 27 {
+		t.Fatalf("Expected 1:14 to 1:27, got %s to %s", rep.Pos(), rep.End())
+	}
+	if s := tree.Root[0].String(); s != "<expr> ::= <term> {\"+\" <term>}" {
+		t.Fatalf("Expected the braces to be kept, got %s", s)
+	}
+
+	if _, err := ParseString("expr = { term ;", lexer.Options{Dialect: lexer.EBNF}); err == nil {
+		t.Fatal("Expected an error for an unclosed brace")
+	}
+}
+
+// Testing if nested calls, literals and lists in actions are parsed into a tree
+func TestParse_ActionArgs(t *testing.T) {
+	buffer := []byte(`<expr> ::= x=<expr> "*" y=<term> { Add(x,Mul(y, -2.5), "a\"b", [x, 'c', []]) }`)
+
+	tree, err := Parse(bytes.NewReader(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seq := tree.Root[0].(*ast.ProdRule).Right.(*ast.Sequence)
+	action := seq.Items[3].(*ast.ActionCall).Action
+	if len(action.Args) != 4 {
+		t.Fatalf("Expected 4 arguments, got %d", len(action.Args))
+	}
+
+	if _, ok := action.Args[0].(*ast.ActionRef); !ok {
+		t.Fatalf("Expected *ast.ActionRef, got %T", action.Args[0])
+	}
+	nested, ok := action.Args[1].(*ast.Action)
+	if !ok {
+		t.Fatalf("Expected *ast.Action, got %T", action.Args[1])
+	}
+	if nested.Action.Lexeme != "Mul" || len(nested.Args) != 2 {
+		t.Fatalf("Expected Mul with 2 arguments, got %s", nested)
+	}
+	if lit, ok := nested.Args[1].(*ast.ActionLiteral); !ok || lit.Token.Type != lexer.ActionNumber {
+		t.Fatalf("Expected a number, got %s", nested.Args[1])
+	}
+	if lit, ok := action.Args[2].(*ast.ActionLiteral); !ok || lit.Token.Lexeme != `a"b` {
+		t.Fatalf("Expected a\"b, got %s", action.Args[2])
+	}
+	list, ok := action.Args[3].(*ast.ActionList)
+	if !ok || len(list.Elems) != 3 {
+		t.Fatalf("Expected a list of 3 elements, got %s", action.Args[3])
+	}
+
+	expected := `{ Add(x, Mul(y, -2.5), "a\"b", [x, "c", []]) }`
+	if seq.Items[3].String() != expected {
+		t.Fatalf("Expected %s, got %s", expected, seq.Items[3])
+	}
+	if text := string(buffer[seq.Items[3].Pos().Offset:seq.Items[3].End().Offset]); text != `Add(x,Mul(y, -2.5), "a\"b", [x, 'c', []])` {
+		t.Fatalf("Unexpected range %s", text)
+	}
+}
+
+// Testing if code blocks are parsed as items of a sequence
+func TestParse_CodeBlock(t *testing.T) {
+	buffer := []byte("<expr> ::= x=<term> {{ return Add(x, y), nil }} | <term>")
+
+	tree, err := Parse(bytes.NewReader(buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alt := tree.Root[0].(*ast.ProdRule).Right.(*ast.Alternation)
+	seq := alt.Alternatives[0].(*ast.Sequence)
+	block, ok := seq.Items[1].(*ast.CodeBlock)
+	if !ok {
+		t.Fatalf("Expected *ast.CodeBlock, got %T", seq.Items[1])
+	}
+	if block.Token.Lexeme != "return Add(x, y), nil" {
+		t.Fatalf("Expected the code, got %q", block.Token.Lexeme)
+	}
+	if text := string(buffer[block.Pos().Offset:block.End().Offset]); text != "{{ return Add(x, y), nil }}" {
+		t.Fatalf("Unexpected range %s", text)
+	}
+}
+
+// Testing if grammars held in strings are parsed like the ones read from a reader
+func TestParseString(t *testing.T) {
+	source := "expr ::= term (\"+\" term)*\nterm ::= [0-9]+"
+	opts := lexer.Options{Dialect: lexer.GBNF}
+
+	expected, err := ParseWithOptions(strings.NewReader(source), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := ParseString(source, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(tree.Root) != fmt.Sprint(expected.Root) {
+		t.Fatalf("Expected %s, got %s", expected.Root, tree.Root)
+	}
+}
+
+// Testing if several files are parsed into one tree with positions resolving to their file
+func TestParseFiles(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.gbnf")
+	b := filepath.Join(dir, "b.gbnf")
+	if err := os.WriteFile(a, []byte("<a> ::= <b>\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, []byte("# b\n<b> ::= x\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fset := lexer.NewFileSet()
+	tree, err := ParseFiles(fset, []string{a, b}, lexer.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Root) != 2 {
+		t.Fatalf("Expected 2 rules, got %d", len(tree.Root))
+	}
+
+	expected := []string{a + ":1:1", b + ":2:1"}
+	for i, node := range tree.Root {
+		if pos := fset.Position(node.Pos().Pos); pos.String() != expected[i] {
+			t.Fatalf("Expected %s, got %s", expected[i], pos)
+		}
+	}
+
+	src := []byte("<abc> ::= xyz\n")
+	tree, err = ParseFile(fset, "d.gbnf", src, lexer.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(src, "<QQQ> ::= WWW\n")
+	if text := tree.Root[0].String(); text != "<abc> ::= \"xyz\"" {
+		t.Fatalf("Expected the tree to keep its source, got %s", text)
+	}
+
+	_, err = ParseFile(fset, "c.gbnf", []byte("<c> ::= <d> !!\n<e> <f>"), lexer.Options{})
+	var perr *Error
+	if !errors.As(err, &perr) || !strings.HasPrefix(err.Error(), "c.gbnf:2:5:") {
+		t.Fatalf("Expected an error at c.gbnf:2:5, got %v", err)
+	}
+}
+
+// Testing if a recovering parse keeps the good rules and puts placeholders where rules are broken
+func TestParse_Recover(t *testing.T) {
+	src := "<a> ::= <b> )\n<c> ::= \"x\" !!\n<d> <e> ::= f\n<g> ::= ( h !!\n<i> ::= j \x01 k\n<l> ::= m"
+
+	tree, err := ParseString(src, lexer.Options{Recover: true})
+	var errs ErrorList
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected an ErrorList, got %v", err)
+	}
+	if tree == nil {
+		t.Fatal("Expected a tree along with the errors")
+	}
+
+	expected := []string{
+		"<a> ::= <bad expression>",
+		"<c> ::= \"x\"",
+		"<bad rule>",
+		"<e> ::= \"f\"",
+		"<g> ::= <bad expression>",
+		"<i> ::= <bad expression>",
+		"<l> ::= \"m\"",
+	}
+	if len(tree.Root) != len(expected) {
+		t.Fatalf("Expected %d nodes, got %d: %v", len(expected), len(tree.Root), tree.Root)
+	}
+	for i, node := range tree.Root {
+		if node.String() != expected[i] {
+			t.Fatalf("Expected %s, got %s", expected[i], node)
+		}
+	}
+
+	lines := []uint{1, 3, 4, 5}
+	if len(errs) != len(lines) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(lines), len(errs), errs)
+	}
+	for i, err := range errs {
+		var line uint
+		var perr *Error
+		var lerr *lexer.Error
+		switch {
+		case errors.As(err, &perr):
+			line = perr.Line
+		case errors.As(err, &lerr):
+			line = lerr.Pos.Line
+		}
+		if line != lines[i] {
+			t.Fatalf("Expected error %d on line %d, got %v", i, lines[i], err)
+		}
+	}
+
+	bad := tree.Root[2].(*ast.BadRule)
+	if bad.Pos().String() != "3:1" || bad.End().String() != "3:4" {
+		t.Fatalf("Expected the bad rule at 3:1-3:4, got %s-%s", bad.Pos(), bad.End())
+	}
+	rule := tree.Root[4].(*ast.ProdRule)
+	if rule.EndOfRule == nil || rule.Right.Pos().String() != "4:9" || rule.Right.End().String() != "4:12" {
+		t.Fatalf("Expected the bad expression at 4:9-4:12 before !!, got %s-%s", rule.Right.Pos(), rule.Right.End())
+	}
+}
+
+// Testing if rules are indexed by name in declaration order, with extensions merged in
+func TestParse_RuleTable(t *testing.T) {
+	tree, err := ParseString("<expr> ::= <term> | <expr> \"+\" <term>\n<term> ::= NUM\n<expr> |= <expr> \"-\" <term>", lexer.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tree.Rules.Len() != 2 || tree.Rules.Rules()[0].Name != "expr" || tree.Rules.Rules()[1].Name != "term" {
+		t.Fatalf("Expected expr and term in order, got %d rules", tree.Rules.Len())
+	}
+
+	expr := tree.Rule("expr")
+	if expr == nil || len(expr.Extensions) != 1 || !expr.Extensions[0].IsExtension() {
+		t.Fatalf("Expected expr to be extended once, got %v", expr)
+	}
+	if s := expr.Expr().String(); s != "<term> | <expr> \"+\" <term> | <expr> \"-\" <term>" {
+		t.Fatalf("Expected the alternatives of the extension to be appended, got %s", s)
+	}
+	if tree.Rule("factor") != nil {
+		t.Fatal("Expected no rule for factor")
+	}
+	if s := tree.Root[2].String(); s != "<expr> |= <expr> \"-\" <term>" {
+		t.Fatalf("Expected the extension to print with |=, got %s", s)
+	}
+}
+
+// Testing if a rule defined twice or extended before it's defined is reported with both positions
+func TestParse_DuplicateRule(t *testing.T) {
+	src := "<a> ::= x\n<b> |= y\n<a> ::= z"
+
+	_, err := ParseString(src, lexer.Options{Filename: "g.gbnf"})
+	var rerr *ast.RuleError
+	if !errors.As(err, &rerr) || !errors.Is(err, ast.ErrUndefinedRule) {
+		t.Fatalf("Expected ErrUndefinedRule, got %v", err)
+	}
+
+	tree, err := ParseString(src, lexer.Options{Filename: "g.gbnf", Recover: true})
+	var errs ErrorList
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %v", err)
+	}
+	if !errors.Is(errs[1], ast.ErrDuplicateRule) || errs[1].Error() != "g.gbnf:3:1: <a>: rule already defined at g.gbnf:1:1" {
+		t.Fatalf("Expected a duplicate rule with both positions, got %v", errs[1])
+	}
+	if tree.Rule("a").Definition != tree.Root[0] {
+		t.Fatal("Expected the first definition to be kept")
+	}
+
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.gbnf")
+	b := filepath.Join(dir, "b.gbnf")
+	if err := os.WriteFile(a, []byte("<a> ::= x\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, []byte("<a> |= y\n<a> ::= z\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseFiles(lexer.NewFileSet(), []string{a, b}, lexer.Options{})
+	if !errors.As(err, &rerr) || rerr.Filename != b || rerr.PrevFilename != a || rerr.Rule.Pos().Line != 2 {
+		t.Fatalf("Expected the duplicate in %s to point back to %s, got %v", b, a, err)
+	}
+}